@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// defaultAdminRoles are granted to migrated admins when the manifest names none.
+var defaultAdminRoles = []string{"BI_ADMIN"}
+
+// AdminsConfig is the admins section of the manifest. It controls the
+// optional step that gives legacy console admins roles in the new model.
+// Admins are matched to destination users by email. When CreateBillingID is
+// set, admins without a matching user get one in that billing account;
+// otherwise they are only reported.
+//
+// Created users are inserted with only id, the email column and billing_id.
+// CreateUserColumns gives the values of any other users column that is NOT
+// NULL without a default, such as a name or status; without them the insert
+// fails on such a column. Each created user is recorded in audit_log so that
+// verify leaves it out of the users comparison.
+type AdminsConfig struct {
+	Roles             []string               `json:"roles,omitempty"`
+	UserEmailColumn   string                 `json:"user_email_column,omitempty"`
+	CreateBillingID   string                 `json:"create_billing_id,omitempty"`
+	CreateUserColumns map[string]interface{} `json:"create_user_columns,omitempty"`
+}
+
+func (c AdminsConfig) roles() []string {
+	if len(c.Roles) > 0 {
+		return c.Roles
+	}
+	return defaultAdminRoles
+}
+
+func (c AdminsConfig) emailColumn() string {
+	if c.UserEmailColumn != "" {
+		return c.UserEmailColumn
+	}
+	return "email"
+}
+
+// createUserStatement returns the insert for users created for admins and the
+// values of its CreateUserColumns, which follow id, email and billing_id.
+func (c AdminsConfig) createUserStatement() (string, []interface{}) {
+	columns := []string{"id", c.emailColumn(), "billing_id"}
+	extra := make([]string, 0, len(c.CreateUserColumns))
+	for col := range c.CreateUserColumns {
+		extra = append(extra, col)
+	}
+	sort.Strings(extra)
+	values := make([]interface{}, len(extra))
+	for i, col := range extra {
+		values[i] = c.CreateUserColumns[col]
+	}
+	columns = append(columns, extra...)
+	return fmt.Sprintf("INSERT INTO users (%s) VALUES (%s)", joinColumns(columns), placeholders(len(columns))), values
+}
+
+// adminUserID derives a stable ID for a user created for an admin, so reruns
+// find the user created by an earlier run instead of adding another one.
+func adminUserID(namespace uuid.UUID, adminId string) string {
+	return uuid.NewSHA1(namespace, []byte("admin/"+adminId)).String()
+}
+
+type adminUser struct {
+	ID        string
+	BillingID string
+}
+
+// migrateAdmins grants the configured roles to the destination user of every
+// legacy admin. Billing-scoped roles are granted once in the user's billing
+// account; team-scoped roles in every team of that account. Admins that
+// cannot be matched or granted a role are written to the admin report.
+func migrateAdmins(sourceDB, destDB *sql.DB, manifest *Manifest, opts migrationOptions, trail *auditTrail) error {
+	config := manifest.Admins
+	billingScoped := manifest.Roles.billingScopedRoles()
+
+	roles, err := loadRoleLookup(destDB)
+	if err != nil {
+		return err
+	}
+	teams, err := fetchTeams(destDB)
+	if err != nil {
+		return err
+	}
+	billingTeams := make(map[string][]string)
+	for _, team := range teams {
+		billingTeams[team.BillingID] = append(billingTeams[team.BillingID], team.ID)
+	}
+	assigned, err := loadUserRoleAssignments(destDB)
+	if err != nil {
+		return err
+	}
+	users, err := fetchUsersByEmail(destDB, config.emailColumn())
+	if err != nil {
+		return err
+	}
+
+	if config.CreateBillingID != "" {
+		var exists bool
+		err := destDB.QueryRow("SELECT EXISTS (SELECT 1 FROM billing_account WHERE id = ?)", config.CreateBillingID).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("error checking create_billing_id: %v", err)
+		}
+		if !exists {
+			return fmt.Errorf("create_billing_id %s is not a destination billing account", config.CreateBillingID)
+		}
+	}
+
+	createQuery, createValues := config.createUserStatement()
+	createStmt, err := destDB.Prepare(createQuery)
+	if err != nil {
+		return fmt.Errorf("error preparing user insert statement: %v", err)
+	}
+	defer createStmt.Close()
+
+	rows, err := sourceDB.Query("SELECT id, email_id FROM admins")
+	if err != nil {
+		return fmt.Errorf("error fetching admins: %v", err)
+	}
+	defer rows.Close()
+
+	inserter := newBatchInserter(destDB, "user_roles_mapping", []string{"user_id", "role_id"}, opts.BatchSize, opts.MaxPacketBytes)
+	defer inserter.Close()
+	inserter.SetConflictPolicy(conflictSkip)
+
+	admins := newReport("admin_id", "email", "user_id", "billing_id", "role", "status", "reason")
+	created := 0
+
+	for rows.Next() {
+		var adminId string
+		var email sql.NullString
+		if err := rows.Scan(&adminId, &email); err != nil {
+			return fmt.Errorf("error scanning admin: %v", err)
+		}
+
+		key := strings.ToLower(strings.TrimSpace(email.String))
+		var user adminUser
+		switch matches := users[key]; {
+		case key == "":
+			admins.Add(adminId, "", "", "", "", assignmentUnresolved, "admin has no email")
+			continue
+		case len(matches) > 1:
+			admins.Add(adminId, email.String, "", "", "", assignmentUnresolved,
+				fmt.Sprintf("email matches %d destination users", len(matches)))
+			continue
+		case len(matches) == 1:
+			user = matches[0]
+		case config.CreateBillingID != "":
+			user = adminUser{ID: adminUserID(opts.RoleNamespace, adminId), BillingID: config.CreateBillingID}
+			args := append([]interface{}{user.ID, email.String, user.BillingID}, createValues...)
+			if _, err := createStmt.Exec(args...); err != nil {
+				return fmt.Errorf("error creating user for admin %s: %v", adminId, err)
+			}
+			record := map[string]interface{}{"user_id": user.ID, "billing_id": user.BillingID, "admin_id": adminId}
+			if err := trail.Add(auditEntityUser, user.ID, "ADMIN", record); err != nil {
+				return err
+			}
+			users[key] = []adminUser{user}
+			created++
+		default:
+			admins.Add(adminId, email.String, "", "", "", assignmentUnresolved, "no destination user with this email")
+			continue
+		}
+
+		for _, roleName := range config.roles() {
+			teamIds := []string{""}
+			if !billingScoped[roleName] {
+				teamIds = billingTeams[user.BillingID]
+			}
+			granted := false
+			for _, teamId := range teamIds {
+				var roleTeamId *string
+				if teamId != "" {
+					roleTeamId = &teamId
+				}
+				roleId, ok := roles[roleScopeKey(roleName, roleTeamId, user.BillingID)]
+				if !ok {
+					continue
+				}
+				if err := inserter.Add([]interface{}{user.ID, roleId}); err != nil {
+					return fmt.Errorf("error inserting into user_roles_mapping: %v", err)
+				}
+				if key := user.ID + "/" + roleId; !assigned[key] {
+					assigned[key] = true
+					grant := map[string]interface{}{"user_id": user.ID, "role_id": roleId, "role": roleName, "team_id": roleTeamId, "billing_id": user.BillingID, "admin_id": adminId}
+					if err := trail.Add(auditEntityUserRole, user.ID, "ADMIN", grant); err != nil {
+						return err
+					}
+				}
+				granted = true
+			}
+			if granted {
+				admins.Add(adminId, email.String, user.ID, user.BillingID, roleName, assignmentAssigned, "")
+			} else {
+				admins.Add(adminId, email.String, user.ID, user.BillingID, roleName, assignmentUnresolved,
+					"no destination role with this name for the user's billing account")
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading admins: %v", err)
+	}
+	if err := inserter.Flush(); err != nil {
+		return fmt.Errorf("error inserting into user_roles_mapping: %v", err)
+	}
+	if err := trail.Flush(destDB); err != nil {
+		return err
+	}
+
+	if err := admins.Write(opts.AdminReport); err != nil {
+		return err
+	}
+	log.Printf("Migrated admins: %d users created, %d role assignments inserted, %d unresolved; see %s",
+		created, inserter.Inserted(), admins.Count("status", assignmentUnresolved), opts.AdminReport)
+	return nil
+}
+
+// fetchUsersByEmail indexes the destination users by lower-cased email.
+func fetchUsersByEmail(db *sql.DB, emailColumn string) (map[string][]adminUser, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT id, billing_id, %s FROM users", emailColumn))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching users: %v", err)
+	}
+	defer rows.Close()
+
+	users := make(map[string][]adminUser)
+	for rows.Next() {
+		var user adminUser
+		var email sql.NullString
+		if err := rows.Scan(&user.ID, &user.BillingID, &email); err != nil {
+			return nil, fmt.Errorf("error scanning user: %v", err)
+		}
+		if key := strings.ToLower(strings.TrimSpace(email.String)); key != "" {
+			users[key] = append(users[key], user)
+		}
+	}
+	return users, rows.Err()
+}
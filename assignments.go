@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Policies for users with no row in user_team_mapping.
+const (
+	// teamlessBillingRoles grants only the billing-scoped roles.
+	teamlessBillingRoles = "billing-roles"
+	// teamlessReport grants nothing and lists the user in the assignment report.
+	teamlessReport = "report"
+)
+
+// Policies for users mapped to more than one team.
+const (
+	// multiTeamReplicate grants each legacy role in every team of the user.
+	multiTeamReplicate = "replicate"
+	// multiTeamPrimary grants legacy roles only in the user's primary team.
+	multiTeamPrimary = "primary"
+)
+
+// Status values of the assignment report.
+const (
+	assignmentAssigned   = "assigned"
+	assignmentSkipped    = "skipped"
+	assignmentUnresolved = "unresolved"
+)
+
+// defaultPrimaryTeamQuery picks a primary team per user. It must return the
+// user ID and team ID; override it in the manifest to use a better rule.
+const defaultPrimaryTeamQuery = "SELECT user_id, MIN(team_id) FROM user_team_mapping GROUP BY user_id"
+
+func newAssignmentReport() *report {
+	return newReport("user_id", "billing_id", "team_id", "legacy_role", "role", "status", "reason")
+}
+
+func (c RolesConfig) primaryTeamQuery() string {
+	if c.PrimaryTeamQuery != "" {
+		return c.PrimaryTeamQuery
+	}
+	return defaultPrimaryTeamQuery
+}
+
+// loadUserTeams returns the teams of every user in the source database.
+func loadUserTeams(db *sql.DB) (map[string][]string, error) {
+	rows, err := db.Query("SELECT user_id, team_id FROM user_team_mapping ORDER BY user_id, team_id")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching user team mappings: %v", err)
+	}
+	defer rows.Close()
+
+	teams := make(map[string][]string)
+	for rows.Next() {
+		var userId, teamId string
+		if err := rows.Scan(&userId, &teamId); err != nil {
+			return nil, fmt.Errorf("error scanning user team mapping: %v", err)
+		}
+		teams[userId] = append(teams[userId], teamId)
+	}
+	return teams, rows.Err()
+}
+
+// loadPrimaryTeams returns the primary team of every user.
+func loadPrimaryTeams(db *sql.DB, query string) (map[string]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching primary teams: %v", err)
+	}
+	defer rows.Close()
+
+	primary := make(map[string]string)
+	for rows.Next() {
+		var userId, teamId string
+		if err := rows.Scan(&userId, &teamId); err != nil {
+			return nil, fmt.Errorf("error scanning primary team: %v", err)
+		}
+		primary[userId] = teamId
+	}
+	return primary, rows.Err()
+}
+
+// primaryTeam returns the user's primary team if it is one of their teams,
+// and otherwise the first of them.
+func primaryTeam(primary map[string]string, userId string, teams []string) string {
+	if teamId, ok := primary[userId]; ok {
+		for _, t := range teams {
+			if t == teamId {
+				return teamId
+			}
+		}
+	}
+	return teams[0]
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// migrationActor and actorTypeSystem mark the audit_log entries written for
+// changes the migration itself makes.
+const (
+	migrationActor  = "rbac-migration"
+	actorTypeSystem = "SYSTEM"
+)
+
+// Entity types of the audit_log entries written by the migration.
+const (
+	auditEntityRole     = "ROLE"
+	auditEntityUserRole = "USER_ROLE"
+	auditEntityUser     = "USER"
+)
+
+// auditLogSchema is the audit_log table the trail writes to. It matches the
+// schema of the audit_logs manifest entry, and is only used to create the
+// table when audit_logs is not migrated.
+const auditLogSchema = "`id` bigint NOT NULL AUTO_INCREMENT," +
+	"`entity_id` varchar(255) NOT NULL," +
+	"`modified_date` datetime(6) NOT NULL," +
+	"`new_value` longtext," +
+	"`old_value` longtext," +
+	"`actor` varchar(255) NOT NULL," +
+	"`actor_type` varchar(255) NOT NULL," +
+	"`entity_info` varchar(255) DEFAULT NULL," +
+	"`entity_type` varchar(255) NOT NULL," +
+	"`operation` enum('ADD','DELETE','UPDATE') NOT NULL," +
+	"PRIMARY KEY (`id`)"
+
+// auditTrailColumns are the audit_log columns filled for migration entries.
+var auditTrailColumns = []string{"id", "actor", "actor_type", "operation", "entity_type", "entity_id", "entity_info", "new_value", "modified_date"}
+
+// auditTrail records the grants made by the migration as ADD entries in the
+// destination audit_log table. Entries are queued until Flush, so they can be
+// written in the same transaction as the grants they describe.
+//
+// Legacy audit rows keep their positive source IDs, so migration entries
+// count down from -1 below the lowest ID in the table. Reruns can then copy
+// new legacy rows without colliding with them.
+type auditTrail struct {
+	opts     migrationOptions
+	nextID   int64
+	pending  [][]interface{}
+	recorded int
+}
+
+func newAuditTrail(db *sql.DB, opts migrationOptions) (*auditTrail, error) {
+	if _, err := db.Exec(createTableStatement("audit_log", auditLogSchema)); err != nil {
+		return nil, fmt.Errorf("error creating audit_log table: %v", err)
+	}
+	var lowest int64
+	if err := db.QueryRow("SELECT COALESCE(MIN(id), 0) FROM audit_log WHERE id < 0").Scan(&lowest); err != nil {
+		return nil, fmt.Errorf("error reading audit_log IDs: %v", err)
+	}
+	return &auditTrail{opts: opts, nextID: lowest - 1}, nil
+}
+
+// Add queues an ADD entry. entityInfo is cut to fit the audit_log column and
+// value is stored as JSON in new_value.
+func (a *auditTrail) Add(entityType, entityId, entityInfo string, value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("error encoding audit value for %s %s: %v", entityType, entityId, err)
+	}
+	entityInfo = truncateRunes(entityInfo, 255)
+	id := a.nextID
+	a.nextID--
+	a.pending = append(a.pending, []interface{}{id, migrationActor, actorTypeSystem, "ADD", entityType, entityId, entityInfo, string(encoded), time.Now().UTC()})
+	return nil
+}
+
+// truncateRunes cuts s to at most limit characters, the unit of a MySQL
+// varchar length, without splitting a multi-byte character.
+func truncateRunes(s string, limit int) string {
+	count := 0
+	for i := range s {
+		if count == limit {
+			return s[:i]
+		}
+		count++
+	}
+	return s
+}
+
+// Flush writes the queued entries through ex, which may be a transaction.
+func (a *auditTrail) Flush(ex execer) error {
+	inserter := newBatchInserter(ex, "audit_log", auditTrailColumns, a.opts.BatchSize, a.opts.MaxPacketBytes)
+	defer inserter.Close()
+	for _, row := range a.pending {
+		if err := inserter.Add(row); err != nil {
+			return fmt.Errorf("error writing audit_log entries: %v", err)
+		}
+	}
+	if err := inserter.Flush(); err != nil {
+		return fmt.Errorf("error writing audit_log entries: %v", err)
+	}
+	a.recorded += inserter.Inserted()
+	a.pending = nil
+	return nil
+}
+
+// Recorded returns the number of entries written so far.
+func (a *auditTrail) Recorded() int {
+	return a.recorded
+}
+
+// legacyRolesByRole inverts the role name mapping: it returns, for each
+// destination role, the legacy roles that map to it.
+func legacyRolesByRole(mapping map[string][]string) map[string]string {
+	legacy := make(map[string][]string)
+	for legacyName, names := range mapping {
+		for _, name := range names {
+			legacy[name] = append(legacy[name], legacyName)
+		}
+	}
+	joined := make(map[string]string, len(legacy))
+	for name, legacyNames := range legacy {
+		sort.Strings(legacyNames)
+		joined[name] = strings.Join(legacyNames, ",")
+	}
+	return joined
+}
+
+// loadUserRoleAssignments returns the assignments already in the destination
+// so reruns only audit grants that are actually new.
+func loadUserRoleAssignments(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query("SELECT user_id, role_id FROM user_roles_mapping")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching user role assignments: %v", err)
+	}
+	defer rows.Close()
+
+	assigned := make(map[string]bool)
+	for rows.Next() {
+		var userId, roleId string
+		if err := rows.Scan(&userId, &roleId); err != nil {
+			return nil, fmt.Errorf("error scanning user role assignment: %v", err)
+		}
+		assigned[userId+"/"+roleId] = true
+	}
+	return assigned, rows.Err()
+}
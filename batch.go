@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const (
+	// maxPlaceholders is the MySQL limit on parameters in a prepared statement.
+	maxPlaceholders = 65535
+	// statementOverhead is reserved in every packet for the statement header.
+	statementOverhead = 1024
+)
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// batchInserter buffers rows and writes them with multi-row INSERT statements.
+// A prepared statement is kept per batch size so full batches reuse the same
+// statement and only the final partial batch needs a new one.
+type batchInserter struct {
+	db        execer
+	table     string
+	columns   []string
+	batchSize int
+	maxPacket int
+
+	// chunkDB, when set, makes every batch run in its own transaction.
+	chunkDB *sql.DB
+	// onFlush runs after each batch is written, in the same transaction.
+	onFlush func(ex execer, batch [][]interface{}) error
+	// conflict is the policy for rows whose key already exists.
+	conflict string
+
+	stmts        map[int]*sql.Stmt
+	pending      [][]interface{}
+	pendingBytes int
+	inserted     int
+}
+
+func newBatchInserter(db execer, table string, columns []string, batchSize, maxPacket int) *batchInserter {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if len(columns) > 0 && batchSize > maxPlaceholders/len(columns) {
+		batchSize = maxPlaceholders / len(columns)
+	}
+	return &batchInserter{
+		db:        db,
+		table:     table,
+		columns:   columns,
+		batchSize: batchSize,
+		maxPacket: maxPacket,
+		stmts:     make(map[int]*sql.Stmt),
+		conflict:  conflictFail,
+	}
+}
+
+// SetConflictPolicy chooses how rows that collide with an existing primary or
+// unique key are handled. It must be called before the first row is added.
+func (b *batchInserter) SetConflictPolicy(policy string) {
+	b.conflict = policy
+}
+
+// Add queues a row, flushing first if the row would push the batch past the
+// configured size or the server's max_allowed_packet.
+func (b *batchInserter) Add(row []interface{}) error {
+	size := rowSize(row)
+	if len(b.pending) > 0 && b.maxPacket > 0 && b.pendingBytes+size+statementOverhead > b.maxPacket {
+		if err := b.Flush(); err != nil {
+			return err
+		}
+	}
+
+	b.pending = append(b.pending, append([]interface{}(nil), row...))
+	b.pendingBytes += size
+
+	if len(b.pending) >= b.batchSize {
+		return b.Flush()
+	}
+	return nil
+}
+
+// CommitEachBatch makes every flushed batch a separate transaction on db.
+// The inserter must have been created with db as its preparer.
+func (b *batchInserter) CommitEachBatch(db *sql.DB) {
+	b.chunkDB = db
+}
+
+// OnFlush registers a hook that runs after every written batch, using the
+// same transaction as the batch when there is one.
+func (b *batchInserter) OnFlush(hook func(ex execer, batch [][]interface{}) error) {
+	b.onFlush = hook
+}
+
+// Flush writes all queued rows.
+func (b *batchInserter) Flush() error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+
+	stmt, err := b.statement(len(b.pending))
+	if err != nil {
+		return err
+	}
+
+	args := make([]interface{}, 0, len(b.pending)*len(b.columns))
+	for _, row := range b.pending {
+		args = append(args, row...)
+	}
+	if err := b.exec(stmt, args); err != nil {
+		return fmt.Errorf("error inserting batch of %d rows into table %s: %v", len(b.pending), b.table, err)
+	}
+
+	b.inserted += len(b.pending)
+	b.pending = b.pending[:0]
+	b.pendingBytes = 0
+	return nil
+}
+
+// Inserted returns the number of rows written so far.
+func (b *batchInserter) Inserted() int {
+	return b.inserted
+}
+
+// Close releases the prepared statements. Queued rows are not flushed.
+func (b *batchInserter) Close() {
+	for _, stmt := range b.stmts {
+		stmt.Close()
+	}
+	b.stmts = make(map[int]*sql.Stmt)
+}
+
+func (b *batchInserter) exec(stmt *sql.Stmt, args []interface{}) error {
+	if b.chunkDB == nil {
+		if _, err := stmt.Exec(args...); err != nil {
+			return err
+		}
+		return b.afterFlush(b.db)
+	}
+
+	tx, err := b.chunkDB.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(stmt).Exec(args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := b.afterFlush(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (b *batchInserter) afterFlush(ex execer) error {
+	if b.onFlush == nil {
+		return nil
+	}
+	return b.onFlush(ex, b.pending)
+}
+
+func (b *batchInserter) statement(rowCount int) (*sql.Stmt, error) {
+	if stmt, ok := b.stmts[rowCount]; ok {
+		return stmt, nil
+	}
+
+	rowPlaceholders := fmt.Sprintf("(%s)", placeholders(len(b.columns)))
+	values := make([]string, rowCount)
+	for i := range values {
+		values[i] = rowPlaceholders
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", b.table, joinColumns(b.columns), strings.Join(values, ", "))
+	clause, err := onDuplicateKeyClause(b.conflict, b.columns)
+	if err != nil {
+		return nil, fmt.Errorf("table %s: %v", b.table, err)
+	}
+	query += clause
+
+	stmt, err := b.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("error preparing insert statement for table %s: %v", b.table, err)
+	}
+	b.stmts[rowCount] = stmt
+	return stmt, nil
+}
+
+// onDuplicateKeyClause returns the ON DUPLICATE KEY UPDATE suffix for a
+// conflict policy. Skipping uses a no-op update rather than INSERT IGNORE so
+// that errors other than duplicate keys still fail the load.
+func onDuplicateKeyClause(policy string, columns []string) (string, error) {
+	var assignments []string
+	switch policy {
+	case conflictFail:
+		return "", nil
+	case conflictSkip:
+		assignments = []string{fmt.Sprintf("`%s` = `%s`", columns[0], columns[0])}
+	case conflictOverwrite:
+		for _, col := range columns {
+			assignments = append(assignments, fmt.Sprintf("`%s` = VALUES(`%s`)", col, col))
+		}
+	case conflictNewer:
+		found := false
+		for _, col := range columns {
+			if col == updatedAtColumn {
+				found = true
+				continue
+			}
+			assignments = append(assignments, newerAssignment(col))
+		}
+		if !found {
+			return "", fmt.Errorf("conflict policy %q needs an %s column", policy, updatedAtColumn)
+		}
+		// Assignments are applied left to right, so updated_at must change last.
+		assignments = append(assignments, newerAssignment(updatedAtColumn))
+	default:
+		return "", fmt.Errorf("unknown conflict policy %q", policy)
+	}
+	return " ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ", "), nil
+}
+
+func newerAssignment(col string) string {
+	return fmt.Sprintf("`%s` = IF(VALUES(`%s`) > `%s`, VALUES(`%s`), `%s`)", col, updatedAtColumn, updatedAtColumn, col, col)
+}
+
+// rowSize estimates how many bytes a row takes on the wire.
+func rowSize(row []interface{}) int {
+	size := 0
+	for _, value := range row {
+		switch v := value.(type) {
+		case []byte:
+			size += len(v) + 9
+		case string:
+			size += len(v) + 9
+		default:
+			size += 9
+		}
+	}
+	return size
+}
+
+func getMaxAllowedPacket(db *sql.DB) (int, error) {
+	var maxPacket int
+	if err := db.QueryRow("SELECT @@max_allowed_packet").Scan(&maxPacket); err != nil {
+		return 0, fmt.Errorf("error reading max_allowed_packet: %v", err)
+	}
+	return maxPacket, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const checkpointTable = "migration_checkpoint"
+
+// checkpoint is the persisted progress of a single table.
+type checkpoint struct {
+	Table      string
+	Completed  bool
+	LastKey    sql.NullString
+	RowsCopied int64
+}
+
+// checkpointStore keeps migration progress in a metadata table of the
+// destination database, so a crashed run can be resumed with -resume.
+type checkpointStore struct {
+	db *sql.DB
+}
+
+func newCheckpointStore(db *sql.DB) (*checkpointStore, error) {
+	createTableQuery := `
+    CREATE TABLE IF NOT EXISTS ` + checkpointTable + ` (
+        table_name VARCHAR(255) NOT NULL,
+        status ENUM('IN_PROGRESS', 'COMPLETED') NOT NULL,
+        last_key VARCHAR(255) NULL,
+        rows_copied BIGINT NOT NULL DEFAULT 0,
+        updated_at DATETIME(6) NOT NULL,
+        PRIMARY KEY (table_name)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`
+	if _, err := db.Exec(createTableQuery); err != nil {
+		return nil, fmt.Errorf("error creating %s table: %v", checkpointTable, err)
+	}
+	return &checkpointStore{db: db}, nil
+}
+
+// Reset forgets all progress from previous runs.
+func (s *checkpointStore) Reset() error {
+	if _, err := s.db.Exec("DELETE FROM " + checkpointTable); err != nil {
+		return fmt.Errorf("error clearing %s table: %v", checkpointTable, err)
+	}
+	return nil
+}
+
+// Load returns the saved progress keyed by source table name.
+func (s *checkpointStore) Load() (map[string]checkpoint, error) {
+	rows, err := s.db.Query("SELECT table_name, status, last_key, rows_copied FROM " + checkpointTable)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s table: %v", checkpointTable, err)
+	}
+	defer rows.Close()
+
+	checkpoints := make(map[string]checkpoint)
+	for rows.Next() {
+		var cp checkpoint
+		var status string
+		if err := rows.Scan(&cp.Table, &status, &cp.LastKey, &cp.RowsCopied); err != nil {
+			return nil, fmt.Errorf("error scanning %s row: %v", checkpointTable, err)
+		}
+		cp.Completed = status == "COMPLETED"
+		checkpoints[cp.Table] = cp
+	}
+	return checkpoints, rows.Err()
+}
+
+// SaveProgress records the last key copied for a table. It takes the executor
+// of the batch being written so the checkpoint commits together with the rows.
+func (s *checkpointStore) SaveProgress(ex execer, table string, lastKey interface{}, rowsCopied int64) error {
+	key := sql.NullString{}
+	if lastKey != nil {
+		key = sql.NullString{String: keyString(lastKey), Valid: true}
+	}
+	_, err := ex.Exec(`INSERT INTO `+checkpointTable+` (table_name, status, last_key, rows_copied, updated_at)
+              VALUES (?, 'IN_PROGRESS', ?, ?, NOW(6))
+              ON DUPLICATE KEY UPDATE status = VALUES(status), last_key = VALUES(last_key), rows_copied = VALUES(rows_copied), updated_at = VALUES(updated_at)`,
+		table, key, rowsCopied)
+	if err != nil {
+		return fmt.Errorf("error saving checkpoint for table %s: %v", table, err)
+	}
+	return nil
+}
+
+// MarkCompleted records that a table has been fully copied.
+func (s *checkpointStore) MarkCompleted(table string, rowsCopied int64) error {
+	_, err := s.db.Exec(`INSERT INTO `+checkpointTable+` (table_name, status, last_key, rows_copied, updated_at)
+              VALUES (?, 'COMPLETED', NULL, ?, NOW(6))
+              ON DUPLICATE KEY UPDATE status = VALUES(status), last_key = VALUES(last_key), rows_copied = VALUES(rows_copied), updated_at = VALUES(updated_at)`,
+		table, rowsCopied)
+	if err != nil {
+		return fmt.Errorf("error marking table %s as completed: %v", table, err)
+	}
+	return nil
+}
+
+// resumeKeyColumn picks the column used to page reads and checkpoint a
+// table: the manifest's key_column, or else a single-column primary key when
+// the table is read without a source_query. A source_query can repeat the
+// primary key, for example through a join, so it is only paged on an
+// explicit key_column. It returns "" when no key applies, and otherwise the
+// key with its database type name.
+func resumeKeyColumn(db *sql.DB, spec TableSpec, sourceQuery string) (string, string, error) {
+	key := spec.KeyColumn
+	if key == "" {
+		if spec.SourceQuery != "" {
+			return "", "", nil
+		}
+		primaryKey, err := getPrimaryKey(db, spec.Name)
+		if err != nil {
+			return "", "", err
+		}
+		if primaryKey == "" || strings.Contains(primaryKey, ",") {
+			return "", "", nil
+		}
+		key = strings.Trim(primaryKey, "`")
+	}
+
+	columns, err := queryColumnTypes(db, sourceQuery)
+	if err != nil {
+		return "", "", err
+	}
+	for _, col := range columns {
+		if col.Name() == key {
+			return key, col.DatabaseTypeName(), nil
+		}
+	}
+	if spec.KeyColumn != "" {
+		return "", "", fmt.Errorf("key_column %s is not a result column of the source query", key)
+	}
+	return "", "", nil
+}
+
+// queryColumnTypes returns the result columns of a query without reading any rows.
+func queryColumnTypes(db *sql.DB, query string) ([]*sql.ColumnType, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT * FROM (%s) AS src LIMIT 0", query))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return rows.ColumnTypes()
+}
+
+// orderedByKey wraps a source query so rows come back in key order, starting
+// after lastKey when it is not nil. lastKey should have the key column's type
+// (see pageKey): a string compared with an integer column is compared as a
+// DOUBLE, which cannot tell large BIGINT keys apart. A positive limit returns
+// one keyset page of at most that many rows.
+func orderedByKey(query, key string, lastKey interface{}, limit int) (string, []interface{}) {
+	var args []interface{}
+	ordered := fmt.Sprintf("SELECT * FROM (%s) AS src", query)
+	if lastKey != nil {
+		ordered += fmt.Sprintf(" WHERE src.`%s` > ?", key)
+		args = append(args, lastKey)
+	}
+	ordered += fmt.Sprintf(" ORDER BY src.`%s`", key)
+	if limit > 0 {
+		ordered += " LIMIT ?"
+		args = append(args, limit)
+	}
+	return ordered, args
+}
+
+// pageKey returns a scanned or checkpointed key as a value to bind against a
+// key column of the given database type. Integer keys become int64 or uint64;
+// anything else is bound as a string.
+func pageKey(value interface{}, typeName string) (interface{}, error) {
+	text, ok := value.(string)
+	if b, isBytes := value.([]byte); isBytes {
+		text, ok = string(b), true
+	}
+	if !ok {
+		return value, nil
+	}
+	switch typeName {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT":
+		key, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s key %q: %v", typeName, text, err)
+		}
+		return key, nil
+	case "UNSIGNED TINYINT", "UNSIGNED SMALLINT", "UNSIGNED MEDIUMINT", "UNSIGNED INT", "UNSIGNED BIGINT":
+		key, err := strconv.ParseUint(text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s key %q: %v", typeName, text, err)
+		}
+		return key, nil
+	}
+	return text, nil
+}
+
+func keyString(value interface{}) string {
+	if b, ok := value.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(value)
+}
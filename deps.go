@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var referencesPattern = regexp.MustCompile("REFERENCES `?([A-Za-z0-9_$]+)`?")
+
+// dependencyGraph records, for every manifest table, the manifest tables its
+// destination foreign keys point to.
+type dependencyGraph struct {
+	tables []string
+	deps   map[string][]string
+}
+
+// buildDependencyGraph reads the foreign keys from the DDL each migrator would
+// create, which covers both the keys copied from the source and the ones the
+// migrators inject (fk_roles_team_id, fk_app_groups_team_id, ...).
+// References to tables outside the manifest and self-references are ignored.
+func buildDependencyGraph(sourceDB *sql.DB, specs []TableSpec) (*dependencyGraph, error) {
+	bySourceOrDestination := make(map[string]string)
+	for _, spec := range specs {
+		bySourceOrDestination[spec.Name] = spec.Name
+		bySourceOrDestination[spec.DestinationTable()] = spec.Name
+	}
+
+	graph := &dependencyGraph{deps: make(map[string][]string)}
+	for _, spec := range specs {
+		graph.tables = append(graph.tables, spec.Name)
+
+		schema, err := newTableMigrator(spec).Schema(sourceDB)
+		if err != nil {
+			return nil, fmt.Errorf("error getting schema for table %s: %v", spec.Name, err)
+		}
+
+		seen := make(map[string]bool)
+		for _, match := range referencesPattern.FindAllStringSubmatch(schema, -1) {
+			target, ok := bySourceOrDestination[match[1]]
+			if !ok || target == spec.Name || seen[target] {
+				continue
+			}
+			seen[target] = true
+			graph.deps[spec.Name] = append(graph.deps[spec.Name], target)
+		}
+	}
+	return graph, nil
+}
+
+// Sort returns the tables ordered so every table follows the tables it
+// references. Ties keep their manifest order. A cycle is reported with its path.
+func (g *dependencyGraph) Sort() ([]string, error) {
+	placed := make(map[string]bool)
+	var order []string
+	for len(order) < len(g.tables) {
+		progressed := false
+		for _, table := range g.tables {
+			if placed[table] || !g.ready(table, placed) {
+				continue
+			}
+			placed[table] = true
+			order = append(order, table)
+			progressed = true
+			break
+		}
+		if !progressed {
+			return nil, fmt.Errorf("foreign key cycle between tables: %s", strings.Join(g.findCycle(placed), " -> "))
+		}
+	}
+	return order, nil
+}
+
+func (g *dependencyGraph) ready(table string, placed map[string]bool) bool {
+	for _, dep := range g.deps[table] {
+		if !placed[dep] {
+			return false
+		}
+	}
+	return true
+}
+
+// findCycle walks unplaced tables until one repeats and returns the loop.
+func (g *dependencyGraph) findCycle(placed map[string]bool) []string {
+	var start string
+	for _, table := range g.tables {
+		if !placed[table] {
+			start = table
+			break
+		}
+	}
+
+	var path []string
+	position := make(map[string]int)
+	for current := start; ; {
+		if i, seen := position[current]; seen {
+			return append(path[i:], current)
+		}
+		position[current] = len(path)
+		path = append(path, current)
+		for _, dep := range g.deps[current] {
+			if !placed[dep] {
+				current = dep
+				break
+			}
+		}
+	}
+}
+
+// orderTables reorders the manifest tables by foreign key dependencies and
+// returns the graph used to do so.
+func orderTables(sourceDB *sql.DB, specs []TableSpec) ([]TableSpec, *dependencyGraph, error) {
+	graph, err := buildDependencyGraph(sourceDB, specs)
+	if err != nil {
+		return nil, nil, err
+	}
+	order, err := graph.Sort()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byName := make(map[string]TableSpec, len(specs))
+	for _, spec := range specs {
+		byName[spec.Name] = spec
+	}
+	ordered := make([]TableSpec, len(order))
+	for i, name := range order {
+		ordered[i] = byName[name]
+	}
+	return ordered, graph, nil
+}
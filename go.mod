@@ -3,8 +3,9 @@ module rbac-migration
 go 1.22.11
 
 require (
-	filippo.io/edwards25519 v1.1.0 // indirect
-	github.com/go-sql-driver/mysql v1.9.1 // indirect
+	github.com/go-sql-driver/mysql v1.9.1
 	github.com/google/uuid v1.6.0
-	github.com/joho/godotenv v1.5.1 // indirect
+	github.com/joho/godotenv v1.5.1
 )
+
+require filippo.io/edwards25519 v1.1.0 // indirect
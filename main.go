@@ -2,50 +2,317 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 )
 
+// Transaction modes for loading a table into the destination.
+const (
+	txModeNone  = "none"
+	txModeTable = "table"
+	txModeChunk = "chunk"
+)
+
+// defaultRoleNamespace is the UUIDv5 namespace role IDs are derived in unless
+// -role-namespace is given.
+const defaultRoleNamespace = "3f6c1d2e-8b4a-5c7d-9e0f-a1b2c3d4e5f6"
+
+// migrationOptions holds the command-line settings shared by the migration steps.
+type migrationOptions struct {
+	BatchSize         int
+	ChunkSize         int
+	MaxPacketBytes    int
+	TxMode            string
+	OnConflict        string
+	RoleNamespace     uuid.UUID
+	RolesMode         string
+	StrictRoleMapping bool
+	AssignmentReport  string
+	MaxUnresolved     int
+	TeamlessUsers     string
+	MultiTeamUsers    string
+	AdminReport       string
+	Concurrency       int
+	MaxOpenConns      int
+	MaxIdleConns      int
+	ConnMaxLifetime   time.Duration
+}
+
 func main() {
-	err := godotenv.Load()
+	manifestPath := flag.String("manifest", "migration.json", "path to the table migration manifest")
+	batchSize := flag.Int("batch-size", 500, "number of rows written per multi-row INSERT")
+	chunkSize := flag.Int("chunk-size", 10000, "rows read per keyset page from tables with a single-column key (0 reads each table in one pass)")
+	txMode := flag.String("tx-mode", txModeNone, "destination transaction scope: none, table or chunk (one batch)")
+	onConflict := flag.String("on-conflict", conflictFail, "default policy for rows that already exist: fail, skip, overwrite or newer (by updated_at)")
+	roleNamespace := flag.String("role-namespace", defaultRoleNamespace, "UUID namespace used to derive deterministic role IDs")
+	rolesMode := flag.String("roles-mode", rolesModeReplace, "how roles are created: replace (delete and recreate) or reconcile (insert missing, report extra)")
+	strictRoleMapping := flag.Bool("strict-role-mapping", false, "abort if a legacy role name is missing from the role name mapping")
+	assignmentReport := flag.String("assignment-report", "assignment-report.csv", "where to write unresolved and policy-driven user role assignments (.csv or .json)")
+	maxUnresolved := flag.Int("max-unresolved", -1, "fail the run if more than this many assignments are unresolved (-1 disables the check)")
+	teamlessUsers := flag.String("teamless-users", teamlessReport, "users without a team: billing-roles (grant billing roles only) or report")
+	multiTeamUsers := flag.String("multi-team-users", multiTeamReplicate, "users in several teams: replicate (grant in every team) or primary")
+	migrateAdminsFlag := flag.Bool("migrate-admins", false, "after user roles, grant the manifest's admin roles to the destination user of every legacy admin")
+	adminReport := flag.String("admin-report", "admin-report.csv", "where to write admin role assignments and unmatched admins (.csv or .json)")
+	snapshot := flag.Bool("snapshot", false, "read every source table from one consistent snapshot and record its binlog position")
+	snapshotOut := flag.String("snapshot-out", "migration-snapshot.json", "where -snapshot records the snapshot's binlog position")
+	resume := flag.Bool("resume", false, "continue from the checkpoint left by an interrupted run")
+	concurrency := flag.Int("concurrency", 1, "number of tables migrated at the same time")
+	maxOpenConns := flag.Int("max-open-conns", 0, "maximum open connections per database (0 means unlimited)")
+	maxIdleConns := flag.Int("max-idle-conns", 2, "maximum idle connections kept per database")
+	connMaxLifetime := flag.Duration("conn-max-lifetime", 0, "maximum time a connection may be reused (0 means forever)")
+	permissionsPath := flag.String("permissions", "permissions.json", "path to the permission catalog seeded with the roles")
+	planOut := flag.String("plan-out", "migration-plan", "file prefix for the plan command's .sql and .json output")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate|plan|verify|merge-billing-roles]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch *txMode {
+	case txModeNone, txModeTable, txModeChunk:
+	default:
+		log.Fatalf("Invalid -tx-mode %q: expected none, table or chunk", *txMode)
+	}
+	if !validConflictPolicy(*onConflict) {
+		log.Fatalf("Invalid -on-conflict %q: expected fail, skip, overwrite or newer", *onConflict)
+	}
+	if *rolesMode != rolesModeReplace && *rolesMode != rolesModeReconcile {
+		log.Fatalf("Invalid -roles-mode %q: expected replace or reconcile", *rolesMode)
+	}
+	if *teamlessUsers != teamlessBillingRoles && *teamlessUsers != teamlessReport {
+		log.Fatalf("Invalid -teamless-users %q: expected billing-roles or report", *teamlessUsers)
+	}
+	if *multiTeamUsers != multiTeamReplicate && *multiTeamUsers != multiTeamPrimary {
+		log.Fatalf("Invalid -multi-team-users %q: expected replicate or primary", *multiTeamUsers)
+	}
+	namespace, err := uuid.Parse(*roleNamespace)
+	if err != nil {
+		log.Fatalf("Invalid -role-namespace %q: %v", *roleNamespace, err)
+	}
+	if *concurrency < 1 {
+		log.Fatalf("Invalid -concurrency %d: must be at least 1", *concurrency)
+	}
+	// Each running table holds one source connection open while it streams rows.
+	if *maxOpenConns > 0 && *maxOpenConns < *concurrency+1 {
+		log.Fatalf("Invalid -max-open-conns %d: need at least -concurrency + 1 (%d)", *maxOpenConns, *concurrency+1)
+	}
+	opts := migrationOptions{
+		BatchSize:         *batchSize,
+		ChunkSize:         *chunkSize,
+		TxMode:            *txMode,
+		OnConflict:        *onConflict,
+		RoleNamespace:     namespace,
+		RolesMode:         *rolesMode,
+		StrictRoleMapping: *strictRoleMapping,
+		AssignmentReport:  *assignmentReport,
+		MaxUnresolved:     *maxUnresolved,
+		TeamlessUsers:     *teamlessUsers,
+		MultiTeamUsers:    *multiTeamUsers,
+		AdminReport:       *adminReport,
+		Concurrency:       *concurrency,
+		MaxOpenConns:      *maxOpenConns,
+		MaxIdleConns:      *maxIdleConns,
+		ConnMaxLifetime:   *connMaxLifetime,
+	}
+
+	err = godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
 
-	sourceDB, err := sql.Open("mysql", os.Getenv("SOURCE_DB_URL"))
+	manifest, err := loadManifest(*manifestPath)
+	if err != nil {
+		log.Fatalf("Could not load migration manifest: %v", err)
+	}
+
+	command := flag.Arg(0)
+	switch command {
+	case "", "migrate", "plan", "verify":
+	case "merge-billing-roles":
+		// Only the destination is touched, so the source is never opened.
+		runMergeBillingRoles(opts)
+		return
+	default:
+		flag.Usage()
+		log.Fatalf("Unknown command %q", command)
+	}
+
+	sourceDSN := os.Getenv("SOURCE_DB_URL")
+	if command == "plan" || command == "verify" {
+		sourceDSN = readOnlyDSN(sourceDSN)
+	}
+
+	var sourceDB *sql.DB
+	if *snapshot {
+		// One snapshot connection per running table, plus one spare.
+		sourceDB, err = openSnapshot(sourceDSN, opts.Concurrency+1, *snapshotOut)
+	} else {
+		sourceDB, err = sql.Open("mysql", sourceDSN)
+	}
 	if err != nil {
 		log.Fatalf("Could not connect to source database: %v", err)
 	}
 	defer sourceDB.Close()
+	if !*snapshot {
+		configurePool(sourceDB, opts)
+	}
 
+	var graph *dependencyGraph
+	manifest.Tables, graph, err = orderTables(sourceDB, manifest.Tables)
+	if err != nil {
+		log.Fatalf("Could not order tables by foreign key dependencies: %v", err)
+	}
+	tableNames := make([]string, len(manifest.Tables))
+	for i, spec := range manifest.Tables {
+		tableNames[i] = spec.Name
+	}
+	log.Printf("Table order: %s", strings.Join(tableNames, ", "))
+
+	switch command {
+	case "", "migrate":
+		catalog, err := loadPermissionCatalog(*permissionsPath)
+		if err != nil {
+			log.Fatalf("Could not load permission catalog: %v", err)
+		}
+		runMigration(sourceDB, manifest, catalog, graph, opts, *resume, *migrateAdminsFlag)
+	case "plan":
+		if err := runPlan(sourceDB, manifest, opts, *planOut); err != nil {
+			log.Fatalf("Failed to build migration plan: %v", err)
+		}
+	case "verify":
+		destDB, err := sql.Open("mysql", readOnlyDSN(os.Getenv("DEST_DB_URL")))
+		if err != nil {
+			log.Fatalf("Could not connect to destination database: %v", err)
+		}
+		defer destDB.Close()
+
+		mismatches, err := runVerify(sourceDB, destDB, manifest)
+		if err != nil {
+			log.Fatalf("Failed to verify migration: %v", err)
+		}
+		if mismatches > 0 {
+			log.Fatalf("Verification failed: %d of %d tables differ between source and destination", mismatches, len(manifest.Tables))
+		}
+		log.Printf("Verification passed for all %d tables.", len(manifest.Tables))
+	}
+}
+
+// runMergeBillingRoles folds duplicate billing-scoped roles in the
+// destination into the role with the derived ID.
+func runMergeBillingRoles(opts migrationOptions) {
 	destDB, err := sql.Open("mysql", os.Getenv("DEST_DB_URL"))
 	if err != nil {
 		log.Fatalf("Could not connect to destination database: %v", err)
 	}
 	defer destDB.Close()
 
-	tables := []string{"timezones", "admins", "billing_account", "team", "users", "roles", "master_encryption_keys", "license_table", "tenant_encryption_keys", "master_plan_table", "tenant_plan_table", "license_store_table", "app_groups", "apps", "audit_logs"}
-	for _, table := range tables {
-		log.Printf("Starting migration for table: %s", table) //add logs for each table row, check source and destination rows count pre and post migration
-		err := migrateTable(sourceDB, destDB, table)
-		if err != nil {
-			log.Fatalf("Failed to migrate table %s: %v", table, err)
+	if err := ensurePermissionTablesExist(destDB); err != nil {
+		log.Fatalf("Failed to ensure permission tables exist: %v", err)
+	}
+	if err := mergeDuplicateBillingRoles(destDB, opts.RoleNamespace); err != nil {
+		log.Fatalf("Failed to merge duplicate billing roles: %v", err)
+	}
+}
+
+// runMigration copies every manifest table and then creates the RBAC roles
+// and user role assignments in the destination database.
+func runMigration(sourceDB *sql.DB, manifest *Manifest, catalog *PermissionCatalog, graph *dependencyGraph, opts migrationOptions, resume, admins bool) {
+	// Unmapped legacy roles are listed, and abort in strict mode, before
+	// anything is written to the destination.
+	if err := checkRoleNameMapping(sourceDB, manifest.Roles.RoleNameMapping(), opts.StrictRoleMapping); err != nil {
+		log.Fatalf("Role name mapping check failed: %v", err)
+	}
+
+	destDB, err := sql.Open("mysql", os.Getenv("DEST_DB_URL"))
+	if err != nil {
+		log.Fatalf("Could not connect to destination database: %v", err)
+	}
+	defer destDB.Close()
+	configurePool(destDB, opts)
+
+	opts.MaxPacketBytes, err = getMaxAllowedPacket(destDB)
+	if err != nil {
+		log.Fatalf("Could not read destination settings: %v", err)
+	}
+
+	checkpoints, err := newCheckpointStore(destDB)
+	if err != nil {
+		log.Fatalf("Could not prepare checkpoint table: %v", err)
+	}
+	progress := map[string]checkpoint{}
+	if resume {
+		progress, err = checkpoints.Load()
+	} else {
+		err = checkpoints.Reset()
+	}
+	if err != nil {
+		log.Fatalf("Could not initialise checkpoints: %v", err)
+	}
+
+	done := make(map[string]bool)
+	var skipped []string
+	for _, spec := range manifest.Tables {
+		if cp, found := progress[spec.Name]; found && cp.Completed {
+			log.Printf("Skipping table %s: already migrated (%d rows) according to checkpoint", spec.Name, cp.RowsCopied)
+			done[spec.Name] = true
+			skipped = append(skipped, spec.Name)
 		}
-		log.Printf("Successfully migrated table: %s", table)
+	}
+
+	result := runTables(manifest.Tables, graph, done, opts.Concurrency, func(spec TableSpec) error {
+		var resumeFrom *checkpoint
+		if cp, found := progress[spec.Name]; found {
+			resumeFrom = &cp
+		}
+
+		log.Printf("Starting migration for table: %s", spec.Name)
+		if err := migrateTable(sourceDB, destDB, newTableMigrator(spec), opts, checkpoints, resumeFrom); err != nil {
+			return err
+		}
+		log.Printf("Successfully migrated table: %s", spec.Name)
 		log.Println(" ")
+		return nil
+	})
+	result.Committed = append(skipped, result.Committed...)
+	if len(result.Failed)+len(result.PostLoadFailed) > 0 {
+		logMigrationSummary(result, opts.TxMode)
+		os.Exit(1)
+	}
+
+	if err := ensurePermissionTablesExist(destDB); err != nil {
+		log.Fatalf("Failed to ensure permission tables exist: %v", err)
+	}
+
+	trail, err := newAuditTrail(destDB, opts)
+	if err != nil {
+		log.Fatalf("Failed to prepare audit trail: %v", err)
 	}
 
 	log.Println("Starting to insert specific roles for each team...")
-	if err := insertRolesForTeams(destDB); err != nil {
+	if opts.RolesMode == rolesModeReconcile {
+		err = reconcileRolesForTeams(destDB, opts.RoleNamespace, manifest.Roles, trail)
+	} else {
+		err = insertRolesForTeams(destDB, opts.RoleNamespace, manifest.Roles, trail)
+	}
+	if err == nil {
+		err = trail.Flush(destDB)
+	}
+	if err != nil {
 		log.Fatalf("Failed to insert roles for teams: %v", err)
 	}
 	log.Println("Successfully inserted roles for all teams.")
+
+	if err := seedPermissions(destDB, opts.RoleNamespace, manifest.Roles, catalog); err != nil {
+		log.Fatalf("Failed to seed role permissions: %v", err)
+	}
 	log.Println(" ")
 
 	// if err := fetchAndDisplayUserRoles(sourceDB); err != nil {
@@ -57,127 +324,250 @@ func main() {
 	}
 
 	log.Println("Fetching user roles information from source database...")
-	if err := fetchAndInsertUserRoles(sourceDB, destDB); err != nil {
+	if err := fetchAndInsertUserRoles(sourceDB, destDB, manifest.Roles, opts, trail); err != nil {
 		log.Fatalf("Failed to fetch and insert user roles information: %v", err)
 	}
+
+	if admins {
+		log.Println("Migrating legacy admins...")
+		if err := migrateAdmins(sourceDB, destDB, manifest, opts, trail); err != nil {
+			log.Fatalf("Failed to migrate admins: %v", err)
+		}
+	}
+	log.Printf("Recorded %d migration grants in audit_log.", trail.Recorded())
 }
 
-func migrateTable(sourceDB, destDB *sql.DB, tableName string) error {
+// migrateTable copies one table and records its progress in checkpoints.
+// When resumeFrom is set, copying continues after the checkpointed key.
+func migrateTable(sourceDB, destDB *sql.DB, migrator TableMigrator, opts migrationOptions, checkpoints *checkpointStore, resumeFrom *checkpoint) error {
+	spec := migrator.Spec()
+	tableName := spec.Name
 	log.Printf("Retrieving schema for table: %s", tableName)
-	destinationTableName := tableName
+	destinationTableName := spec.DestinationTable()
 
-	schema, err := getTableSchema(sourceDB, tableName)
+	schema, err := migrator.Schema(sourceDB)
 	if err != nil {
 		return fmt.Errorf("error getting schema for table %s: %v", tableName, err)
 	}
 
-	if tableName == "apps" || tableName == "app_groups" {
-		additionalColumns := ", `created_by` varchar(255), `updated_by` varchar(255)"
-		schema += additionalColumns
-	}
-
-	if tableName == "app_groups" {
-		schema += ", `team_id` CHAR(36)"
+	_, err = destDB.Exec(createTableStatement(destinationTableName, schema))
+	if err != nil {
+		return fmt.Errorf("error creating table %s in destination database: %v", tableName, err)
 	}
 
-	if tableName == "apps" {
-		// Rename 'key' to 'key_value' and 'label' to 'label_value'
-		schema = strings.Replace(schema, "`key`", "`key_value`", 1)
-		schema = strings.Replace(schema, "`label`", "`label_value`", 1)
+	query := migrator.SourceQuery()
+	keyColumn, keyType, err := resumeKeyColumn(sourceDB, spec, query)
+	if err != nil {
+		return fmt.Errorf("error determining checkpoint key for table %s: %v", tableName, err)
 	}
 
-	if tableName == "audit_logs" {
-		destinationTableName = "audit_log"
-		schema = "`id` bigint NOT NULL AUTO_INCREMENT," +
-			"`entity_id` varchar(255) NOT NULL," +
-			"`modified_date` datetime(6) NOT NULL," +
-			"`new_value` longtext," +
-			"`old_value` longtext," +
-			"`actor` varchar(255) NOT NULL," +
-			"`actor_type` varchar(255) NOT NULL," +
-			"`entity_info` varchar(255) DEFAULT NULL," +
-			"`entity_type` varchar(255) NOT NULL," +
-			"`operation` enum('ADD','DELETE','UPDATE') NOT NULL," +
-			"PRIMARY KEY (`id`)"
+	// lastKey keeps the key column's type for paging; checkpoints store it
+	// as a string.
+	var lastKey interface{}
+	var rowsCopied int64
+	if keyColumn != "" {
+		if resumeFrom != nil {
+			rowsCopied = resumeFrom.RowsCopied
+			if resumeFrom.LastKey.Valid {
+				if lastKey, err = pageKey(resumeFrom.LastKey.String, keyType); err != nil {
+					return fmt.Errorf("error reading checkpoint of table %s: %v", tableName, err)
+				}
+				log.Printf("Resuming table %s after %s = %s (%d rows already copied)", tableName, keyColumn, resumeFrom.LastKey.String, rowsCopied)
+			}
+		}
+	} else if resumeFrom != nil {
+		log.Printf("Table %s has no single-column key to resume from; clearing %s and copying it again", tableName, destinationTableName)
+		if _, err := destDB.Exec(fmt.Sprintf("DELETE FROM %s", destinationTableName)); err != nil {
+			return fmt.Errorf("error clearing partially migrated table %s: %v", destinationTableName, err)
+		}
 	}
 
-	_, err = destDB.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", destinationTableName, schema))
-	if err != nil {
-		return fmt.Errorf("error creating table %s in destination database: %v", tableName, err)
+	// Tables with a key are read in keyset pages of opts.ChunkSize rows so no
+	// single result set stays open for the whole table. Tables without one
+	// fall back to a single streaming read.
+	readChunk := func() (*sql.Rows, error) {
+		if keyColumn == "" {
+			return sourceDB.Query(query)
+		}
+		chunkQuery, args := orderedByKey(query, keyColumn, lastKey, opts.ChunkSize)
+		return sourceDB.Query(chunkQuery, args...)
 	}
 
 	log.Printf("Migrating data for table: %s", tableName)
-	var query string
-	if tableName == "apps" {
-		query = "SELECT id, `key` AS key_value, label AS label_value, group_id, created_at, updated_at FROM apps"
-	} else if tableName == "audit_logs" {
-		query = "SELECT a.email_id AS actor, al.action AS operation, al.target AS entity_type, 'ADMIN' AS actor_type, al.target_id AS entity_id, al.created_at AS modified_date, al.target_info AS entity_info FROM audit_logs al LEFT JOIN admins a ON a.id = al.admin_id"
-	} else if tableName == "app_groups" {
-		query = `SELECT ag.id, ag.name, ag.user_id, ag.created_at, ag.updated_at, utm.team_id FROM app_groups ag LEFT JOIN user_team_mapping utm ON ag.user_id = utm.user_id`
-	} else {
-		query = fmt.Sprintf("SELECT * FROM %s", tableName)
+	if keyColumn == "" && opts.ChunkSize > 0 {
+		log.Printf("Table %s has no single-column key to page on; reading it in one pass", tableName)
 	}
-	rows, err := sourceDB.Query(query)
+	rows, err := readChunk()
 	if err != nil {
 		return fmt.Errorf("error querying data from table %s: %v", tableName, err)
 	}
-	defer rows.Close()
+	defer func() { rows.Close() }()
 
-	columns, err := rows.Columns()
+	sourceColumns, err := rows.Columns()
 	if err != nil {
 		return fmt.Errorf("error retrieving columns from table %s: %v", tableName, err)
 	}
-
-	if tableName == "apps" {
-		for i, col := range columns {
-			if col == "key" {
-				columns[i] = "key_value"
-			} else if col == "label" {
-				columns[i] = "label_value"
-			}
+	columns := migrator.DestinationColumns(sourceColumns)
+
+	// Pages continue from the key of the last source row read, while
+	// checkpoints read it from transformed rows, which follow the
+	// destination columns.
+	sourceKeyIndex, keyIndex := -1, -1
+	for i, col := range sourceColumns {
+		if keyColumn != "" && col == keyColumn {
+			sourceKeyIndex = i
+		}
+	}
+	for i, col := range columns {
+		if keyColumn != "" && col == spec.RenameColumn(keyColumn) {
+			keyIndex = i
 		}
 	}
 
-	values := make([]interface{}, len(columns))
-	valuePtrs := make([]interface{}, len(columns))
+	values := make([]interface{}, len(sourceColumns))
+	valuePtrs := make([]interface{}, len(sourceColumns))
 	for i := range values {
 		valuePtrs[i] = &values[i]
 	}
 
-	insertStmt := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", destinationTableName, joinColumns(columns), placeholders(len(columns)))
-	sourceCount := 0
-	insertCount := 0
-	for rows.Next() {
-		sourceCount++
-		err = rows.Scan(valuePtrs...)
+	var target execer = destDB
+	var tx *sql.Tx
+	if opts.TxMode == txModeTable {
+		tx, err = destDB.Begin()
 		if err != nil {
-			return fmt.Errorf("error scanning data from table %s: %v", tableName, err)
+			return fmt.Errorf("error starting transaction for table %s: %v", tableName, err)
 		}
+		// Rollback is a no-op once the transaction has been committed.
+		defer tx.Rollback()
+		target = tx
+	}
 
-		_, err = destDB.Exec(insertStmt, values...)
-		if err != nil {
-			return fmt.Errorf("error inserting data into table %s: %v", tableName, err)
+	inserter := newBatchInserter(target, destinationTableName, columns, opts.BatchSize, opts.MaxPacketBytes)
+	defer inserter.Close()
+	if opts.TxMode == txModeChunk {
+		inserter.CommitEachBatch(destDB)
+	}
+	inserter.SetConflictPolicy(spec.ConflictPolicy(opts.OnConflict))
+	inserter.OnFlush(func(ex execer, batch [][]interface{}) error {
+		var lastKey interface{}
+		if keyIndex >= 0 {
+			lastKey = batch[len(batch)-1][keyIndex]
+		}
+		return checkpoints.SaveProgress(ex, tableName, lastKey, rowsCopied+int64(inserter.Inserted()+len(batch)))
+	})
+
+	start := time.Now()
+	sourceCount, skippedCount := 0, 0
+	for {
+		chunkCount := 0
+		for rows.Next() {
+			sourceCount++
+			chunkCount++
+			err = rows.Scan(valuePtrs...)
+			if err != nil {
+				return fmt.Errorf("error scanning data from table %s: %v", tableName, err)
+			}
+			if sourceKeyIndex >= 0 && values[sourceKeyIndex] != nil {
+				if lastKey, err = pageKey(values[sourceKeyIndex], keyType); err != nil {
+					return fmt.Errorf("error reading key of table %s: %v", tableName, err)
+				}
+			}
+
+			row, err := migrator.TransformRow(values)
+			if err == errSkipRow {
+				skippedCount++
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("error transforming data from table %s: %v", tableName, err)
+			}
+
+			if err := inserter.Add(row); err != nil {
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error reading data from table %s: %v", tableName, err)
+		}
+		rows.Close()
+
+		if keyColumn == "" || opts.ChunkSize <= 0 || chunkCount < opts.ChunkSize {
+			break
+		}
+		if rows, err = readChunk(); err != nil {
+			return fmt.Errorf("error querying data from table %s: %v", tableName, err)
+		}
+	}
+	if skippedCount > 0 && !skippedRowsAllowed(migrator) {
+		return fmt.Errorf("%d rows of table %s were skipped and the table does not allow skipped rows", skippedCount, tableName)
+	}
+	if err := inserter.Flush(); err != nil {
+		return err
+	}
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error committing table %s: %v", tableName, err)
 		}
-		insertCount++
 	}
+	elapsed := time.Since(start)
 
-	log.Printf("Migrated %d records from source table %s.", sourceCount, tableName)
-	log.Printf("Inserted %d records into destination table %s.", insertCount, tableName)
+	insertCount := inserter.Inserted()
+	log.Printf("Migrated %d records from source table %s (%d skipped).", sourceCount, tableName, skippedCount)
+	log.Printf("Inserted %d records into destination table %s in %s (%.0f rows/sec).", insertCount, tableName, elapsed.Round(time.Millisecond), float64(insertCount)/elapsed.Seconds())
 
+	// The rows are committed from here on; failures are reported as such.
+	if err := migrator.PostLoad(sourceDB, destDB); err != nil {
+		return &postLoadError{fmt.Errorf("error running post-load step for table %s: %v", tableName, err)}
+	}
+	if err := checkpoints.MarkCompleted(tableName, rowsCopied+int64(insertCount)); err != nil {
+		return &postLoadError{err}
+	}
 	return nil
 }
 
-func insertRolesForTeams(db *sql.DB) error {
+func createTableStatement(tableName, schema string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", tableName, schema)
+}
+
+// logMigrationSummary records which tables made it into the destination
+// before the run stopped.
+func logMigrationSummary(result tableRunResult, txMode string) {
+	log.Println("Migration stopped. Summary:")
+	for _, table := range result.Committed {
+		log.Printf("  committed:   %s", table)
+	}
+	for _, table := range result.PostLoadFailed {
+		log.Printf("  committed:   %s (post-load failed)", table)
+	}
+	for _, table := range result.Failed {
+		switch txMode {
+		case txModeTable:
+			log.Printf("  rolled back: %s", table)
+		case txModeChunk:
+			log.Printf("  partial:     %s (batches before the failing one were committed)", table)
+		default:
+			log.Printf("  partial:     %s (rows inserted before the failure were kept)", table)
+		}
+	}
+	for _, table := range result.NotStarted {
+		log.Printf("  not started: %s", table)
+	}
+}
+
+func insertRolesForTeams(db *sql.DB, namespace uuid.UUID, config RolesConfig, trail *auditTrail) error {
+	// Role permissions are derived from the catalog and reseeded after the roles.
+	if _, err := db.Exec("DELETE FROM role_permissions_mapping"); err != nil {
+		return fmt.Errorf("error clearing role_permissions_mapping table: %v", err)
+	}
 	if _, err := db.Exec("DELETE FROM roles"); err != nil {
 		return fmt.Errorf("error clearing roles table: %v", err)
 	}
 
-	log.Println("Fetching all team IDs from the team table...")
-	rows, err := db.Query("SELECT id, billing_id FROM team")
+	log.Println("Fetching all billing accounts and team IDs...")
+	scope, err := fetchRoleScope(db, config)
 	if err != nil {
-		return fmt.Errorf("error fetching team ids: %v", err)
+		return err
 	}
-	defer rows.Close()
 
 	log.Println("Preparing statement for inserting roles...")
 	stmt, err := db.Prepare(`INSERT INTO roles (id, name, type, team_id, billing_id) VALUES (?, ?, ?, ?, ?)`)
@@ -186,59 +576,124 @@ func insertRolesForTeams(db *sql.DB) error {
 	}
 	defer stmt.Close()
 
-	var count int
-	for rows.Next() {
-		var teamId string
-		var billingId string
-		if err := rows.Scan(&teamId, &billingId); err != nil {
-			return fmt.Errorf("error scanning team id: %v", err)
-		}
-
-		log.Printf("Inserting roles for team ID: %s\n", teamId)
-		if err := insertRole(stmt, "BI_ADMIN", "BILLING", nil, &billingId); err != nil {
+	legacy := legacyRolesByRole(config.RoleNameMapping())
+	roles := desiredRoles(namespace, config.RoleTemplates(), scope)
+	for _, role := range roles {
+		if err := insertRole(stmt, role); err != nil {
 			return err
 		}
-		if err := insertRole(stmt, "PLATFORM_ADMIN", "STANDARD", &teamId, &billingId); err != nil {
+		if err := trail.Add(auditEntityRole, role.ID, legacy[role.Name], role); err != nil {
 			return err
 		}
-		if err := insertRole(stmt, "PLATFORM_READ_ONLY", "STANDARD", &teamId, &billingId); err != nil {
-			return err
-		}
-		count += 3
 	}
 
-	log.Printf("Inserted a total of %d roles for all teams.\n", count)
+	log.Printf("Inserted a total of %d roles for %d billing accounts and %d teams.\n", len(roles), len(scope.BillingIDs), len(scope.Teams))
 	return nil
 }
 
-func insertRole(stmt *sql.Stmt, name string, roleType string, teamId *string, billingId *string) error {
-	newUUID, err := uuid.NewRandom()
+func fetchBillingAccounts(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT id FROM billing_account")
 	if err != nil {
-		return fmt.Errorf("error generating UUID: %v", err)
+		return nil, fmt.Errorf("error fetching billing_account ids: %v", err)
 	}
+	defer rows.Close()
 
-	var result sql.Result
-	if teamId == nil {
-		result, err = stmt.Exec(newUUID.String(), name, roleType, nil, *billingId)
-	} else {
-		result, err = stmt.Exec(newUUID.String(), name, roleType, *teamId, *billingId)
+	var billingIds []string
+	for rows.Next() {
+		var billingId string
+		if err := rows.Scan(&billingId); err != nil {
+			return nil, fmt.Errorf("error scanning billing_account id: %v", err)
+		}
+		billingIds = append(billingIds, billingId)
 	}
+	return billingIds, rows.Err()
+}
 
+// teamRef identifies a team and the billing account it belongs to.
+type teamRef struct {
+	ID        string
+	BillingID string
+}
+
+func fetchTeams(db *sql.DB) ([]teamRef, error) {
+	rows, err := db.Query("SELECT id, billing_id FROM team")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching team ids: %v", err)
+	}
+	defer rows.Close()
+
+	var teams []teamRef
+	for rows.Next() {
+		var team teamRef
+		if err := rows.Scan(&team.ID, &team.BillingID); err != nil {
+			return nil, fmt.Errorf("error scanning team id: %v", err)
+		}
+		teams = append(teams, team)
+	}
+	return teams, rows.Err()
+}
+
+// plannedRole is a row the migration creates in the destination roles table.
+type plannedRole struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	Type      string  `json:"type"`
+	TeamID    *string `json:"team_id"`
+	BillingID string  `json:"billing_id"`
+}
+
+// desiredRoles expands the role templates: billing-scoped roles once per
+// billing account, followed by team-scoped roles for every team.
+func desiredRoles(namespace uuid.UUID, templates []RoleTemplate, scope roleScope) []plannedRole {
+	var roles []plannedRole
+	for _, billingId := range scope.BillingIDs {
+		for _, template := range templates {
+			if template.Scope == scopeBilling && template.appliesTo(scope.Plans[billingId]) {
+				roles = append(roles, plannedRole{Name: template.Name, Type: template.Type, TeamID: nil, BillingID: billingId})
+			}
+		}
+	}
+	for _, team := range scope.Teams {
+		teamId := team.ID
+		for _, template := range templates {
+			if template.Scope == scopeTeam && template.appliesTo(scope.Plans[team.BillingID]) {
+				roles = append(roles, plannedRole{Name: template.Name, Type: template.Type, TeamID: &teamId, BillingID: team.BillingID})
+			}
+		}
+	}
+	for i := range roles {
+		roles[i].ID = roleID(namespace, roles[i].Name, roles[i].TeamID, roles[i].BillingID)
+	}
+	return roles
+}
+
+// roleID derives a UUIDv5 from the role's scope and name, so every run gives
+// the same role the same ID.
+func roleID(namespace uuid.UUID, name string, teamId *string, billingId string) string {
+	return uuid.NewSHA1(namespace, []byte(roleScopeKey(name, teamId, billingId))).String()
+}
+
+func insertRole(stmt *sql.Stmt, role plannedRole) error {
+	var teamId interface{}
+	if role.TeamID != nil {
+		teamId = *role.TeamID
+	}
+
+	result, err := stmt.Exec(role.ID, role.Name, role.Type, teamId, role.BillingID)
 	if err != nil {
 		return fmt.Errorf("error inserting role: %v", err)
 	}
 
 	rowsAffected, _ := result.RowsAffected()
 	teamIdValue := "<nil>"
-	if teamId != nil {
-		teamIdValue = *teamId
+	if role.TeamID != nil {
+		teamIdValue = *role.TeamID
 	}
-	log.Printf("Inserted role: %s, Type: %s, Team ID: %v, Rows affected: %d\n", name, roleType, teamIdValue, rowsAffected)
+	log.Printf("Inserted role: %s, ID: %s, Type: %s, Team ID: %v, Rows affected: %d\n", role.Name, role.ID, role.Type, teamIdValue, rowsAffected)
 	return nil
 }
 
-func ensureUserRolesMappingTableExists(db *sql.DB) error {
-	createTableQuery := `
+const userRolesMappingTableQuery = `
     CREATE TABLE IF NOT EXISTS user_roles_mapping (
         user_id CHAR(36) NOT NULL,
         role_id CHAR(36) NOT NULL,
@@ -246,7 +701,9 @@ func ensureUserRolesMappingTableExists(db *sql.DB) error {
         FOREIGN KEY (user_id) REFERENCES users(id),
         FOREIGN KEY (role_id) REFERENCES roles(id)
     ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`
-	_, err := db.Exec(createTableQuery)
+
+func ensureUserRolesMappingTableExists(db *sql.DB) error {
+	_, err := db.Exec(userRolesMappingTableQuery)
 	if err != nil {
 		return fmt.Errorf("error creating user_roles_mapping table: %v", err)
 	}
@@ -309,82 +766,185 @@ func fetchAndDisplayUserRoles(db *sql.DB) error {
 	return nil
 }
 
-func fetchAndInsertUserRoles(sourceDB, destDB *sql.DB) error {
-	query := `SELECT u.id AS user_id, ba.id AS billing_id, utm.team_id, r.name AS role_name
+func fetchAndInsertUserRoles(sourceDB, destDB *sql.DB, config RolesConfig, opts migrationOptions, trail *auditTrail) error {
+	mapping := config.RoleNameMapping()
+	billingScoped := config.billingScopedRoles()
+
+	log.Println("Loading destination roles...")
+	roles, err := loadRoleLookup(destDB)
+	if err != nil {
+		return err
+	}
+
+	assigned, err := loadUserRoleAssignments(destDB)
+	if err != nil {
+		return err
+	}
+
+	userTeams, err := loadUserTeams(sourceDB)
+	if err != nil {
+		return err
+	}
+	var primaryTeams map[string]string
+	if opts.MultiTeamUsers == multiTeamPrimary {
+		if primaryTeams, err = loadPrimaryTeams(sourceDB, config.primaryTeamQuery()); err != nil {
+			return err
+		}
+	}
+
+	// The assignments are loaded in one transaction so that crossing
+	// -max-unresolved leaves none of them, nor their audit entries, behind.
+	tx, err := destDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT u.id AS user_id, ba.id AS billing_id, r.name AS role_name
               FROM users u
               JOIN billing_account ba ON u.billing_id = ba.id
               JOIN users_role ur ON u.id = ur.user_id
-              JOIN roles r ON ur.role_id = r.id
-              JOIN user_team_mapping utm ON u.id = utm.user_id`
+              JOIN roles r ON ur.role_id = r.id`
 	rows, err := sourceDB.Query(query)
 	if err != nil {
 		return fmt.Errorf("error fetching user roles data: %v", err)
 	}
 	defer rows.Close()
 
-	// log.Println("Preparing statement for inserting into user_roles_mapping in destDB...")
-	insertStmt, err := destDB.Prepare(`INSERT IGNORE INTO user_roles_mapping (user_id, role_id) VALUES (?, ?)`)
-	if err != nil {
-		return fmt.Errorf("error preparing insert statement: %v", err)
-	}
-	defer insertStmt.Close()
+	inserter := newBatchInserter(tx, "user_roles_mapping", []string{"user_id", "role_id"}, opts.BatchSize, opts.MaxPacketBytes)
+	defer inserter.Close()
+	inserter.SetConflictPolicy(conflictSkip)
+
+	assignments := newAssignmentReport()
 
 	for rows.Next() {
-		var userId, billingId, teamId, roleName string
-		if err := rows.Scan(&userId, &billingId, &teamId, &roleName); err != nil {
+		var userId, billingId, legacyRoleName string
+		if err := rows.Scan(&userId, &billingId, &legacyRoleName); err != nil {
 			return fmt.Errorf("error scanning user roles data: %v", err)
 		}
 
-		roleName = transformRoleName(roleName)
-
-		var roleId string
-		roleQuery := `SELECT id FROM roles WHERE name = ? AND billing_id = ?`
-		if roleName == "BI_ADMIN" {
-			err = destDB.QueryRow(roleQuery, roleName, billingId).Scan(&roleId)
-		} else {
-			roleQuery += " AND team_id = ?"
-			err = destDB.QueryRow(roleQuery, roleName, billingId, teamId).Scan(&roleId)
+		// An empty team ID stands for "no team": only billing roles apply.
+		teams := userTeams[userId]
+		switch {
+		case len(teams) == 0 && opts.TeamlessUsers == teamlessReport:
+			assignments.Add(userId, billingId, "", legacyRoleName, "", assignmentUnresolved, "user has no team mapping")
+			continue
+		case len(teams) == 0:
+			teams = []string{""}
+		case len(teams) > 1 && opts.MultiTeamUsers == multiTeamPrimary:
+			primary := primaryTeam(primaryTeams, userId, teams)
+			assignments.Add(userId, billingId, primary, legacyRoleName, "", assignmentAssigned,
+				fmt.Sprintf("legacy role granted in primary team only; user is in %d teams", len(teams)))
+			teams = []string{primary}
+		case len(teams) > 1:
+			assignments.Add(userId, billingId, strings.Join(teams, " "), legacyRoleName, "", assignmentAssigned,
+				fmt.Sprintf("legacy role replicated across all %d teams of the user", len(teams)))
 		}
-		if err != nil {
-			if err == sql.ErrNoRows {
-				log.Printf("No role found for Role Name: %s, Billing ID: %s, Team ID: %s. Skipping insertion.", roleName, billingId, teamId)
-				continue
-			} else {
-				return fmt.Errorf("error fetching role id for role name %s with billing_id %s and team_id %s: %v", roleName, billingId, teamId, err)
+
+		for _, teamId := range teams {
+			for _, roleName := range transformRoleName(mapping, legacyRoleName) {
+				var roleTeamId *string
+				if !billingScoped[roleName] {
+					if teamId == "" {
+						assignments.Add(userId, billingId, "", legacyRoleName, roleName, assignmentSkipped, "team role not granted to a user without a team")
+						continue
+					}
+					roleTeamId = &teamId
+				}
+
+				roleId, ok := roles[roleScopeKey(roleName, roleTeamId, billingId)]
+				if !ok {
+					reason := "no destination role with this name for the billing account and team"
+					if _, mapped := mapping[legacyRoleName]; !mapped {
+						reason = "legacy role is not in the role name mapping and no destination role has its name"
+					}
+					assignments.Add(userId, billingId, teamId, legacyRoleName, roleName, assignmentUnresolved, reason)
+					continue
+				}
+
+				if err := inserter.Add([]interface{}{userId, roleId}); err != nil {
+					return fmt.Errorf("error inserting into user_roles_mapping: %v", err)
+				}
+				if key := userId + "/" + roleId; !assigned[key] {
+					assigned[key] = true
+					grant := map[string]interface{}{"user_id": userId, "role_id": roleId, "role": roleName, "team_id": roleTeamId, "billing_id": billingId}
+					if err := trail.Add(auditEntityUserRole, userId, legacyRoleName, grant); err != nil {
+						return err
+					}
+				}
 			}
 		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading user roles data: %v", err)
+	}
 
-		log.Printf("Inserting into user_roles_mapping: UserID: %s, RoleID: %s", userId, roleId)
-		if _, err := insertStmt.Exec(userId, roleId); err != nil {
-			return fmt.Errorf("error inserting into user_roles_mapping: %v", err)
-		}
+	if err := assignments.Write(opts.AssignmentReport); err != nil {
+		return err
+	}
+	unresolved := assignments.Count("status", assignmentUnresolved)
+	log.Printf("%d user role assignments could not be resolved and %d were skipped by policy; see %s",
+		unresolved, assignments.Count("status", assignmentSkipped), opts.AssignmentReport)
+	if opts.MaxUnresolved >= 0 && unresolved > opts.MaxUnresolved {
+		return fmt.Errorf("%d unresolved user role assignments exceed -max-unresolved %d; no assignments were written", unresolved, opts.MaxUnresolved)
+	}
+
+	if err := inserter.Flush(); err != nil {
+		return fmt.Errorf("error inserting into user_roles_mapping: %v", err)
+	}
+	if err := trail.Flush(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing user role assignments: %v", err)
 	}
 
-	log.Println("Successfully fetched and inserted user roles information.")
+	log.Printf("Successfully fetched and inserted %d user role assignments.", inserter.Inserted())
 	return nil
 }
 
-func transformRoleName(sourceRoleName string) string {
-	switch sourceRoleName {
-	case "USER":
-		return "PLATFORM_READ_ONLY"
-	case "TEAM_ADMIN":
-		return "PLATFORM_ADMIN"
-	default:
-		return sourceRoleName
+// loadRoleLookup reads every destination role into a map keyed by
+// roleScopeKey. When several roles share a key, a non-CUSTOM role wins.
+func loadRoleLookup(db *sql.DB) (map[string]string, error) {
+	existing, err := fetchExistingRoles(db)
+	if err != nil {
+		return nil, err
 	}
+
+	lookup := make(map[string]string, len(existing))
+	custom := make(map[string]bool)
+	for _, role := range existing {
+		key := roleScopeKey(role.Name, nullableString(role.TeamID), role.BillingID.String)
+		if _, found := lookup[key]; found && !custom[key] {
+			continue
+		}
+		lookup[key] = role.ID
+		custom[key] = role.Type == "CUSTOM"
+	}
+	return lookup, nil
 }
-func getTableSchema(db *sql.DB, tableName string) (string, error) {
+
+// transformRoleName returns the destination roles granted by a legacy role.
+// Names missing from the mapping are passed through unchanged.
+func transformRoleName(mapping map[string][]string, sourceRoleName string) []string {
+	if names, ok := mapping[sourceRoleName]; ok {
+		return names
+	}
+	return []string{sourceRoleName}
+}
+
+func getTableSchema(db *sql.DB, spec TableSpec) (string, error) {
+	tableName := spec.Name
+
 	// Retrieve column definitions
 	columns, err := getColumnDefinitions(db, tableName)
 	if err != nil {
 		return "", err
 	}
 
-	// Check if the table is 'roles' and modify the schema accordingly
-	if tableName == "roles" {
-		additionalColumns := ", `created_by` varchar(255), `updated_by` varchar(255), `type` enum('BILLING', 'STANDARD', 'CUSTOM') NOT NULL DEFAULT 'STANDARD', `team_id` char(36), `billing_id` char(36)"
-		columns += additionalColumns
+	// Append the columns the manifest adds on top of the source definition
+	if len(spec.ExtraColumns) > 0 {
+		columns += ", " + strings.Join(spec.ExtraColumns, ", ")
 	}
 
 	// Retrieve primary key
@@ -411,14 +971,8 @@ func getTableSchema(db *sql.DB, tableName string) (string, error) {
 		return "", err
 	}
 
-	// Add a foreign key for 'roles' table specifically
-	if tableName == "roles" {
-		foreignKeys = append(foreignKeys, "CONSTRAINT `fk_roles_team_id` FOREIGN KEY (`team_id`) REFERENCES `team` (`id`)")
-	}
-
-	if tableName == "app_groups" {
-		foreignKeys = append(foreignKeys, "CONSTRAINT `fk_app_groups_team_id` FOREIGN KEY (`team_id`) REFERENCES `team` (`id`)")
-	}
+	// Add the foreign keys declared in the manifest
+	foreignKeys = append(foreignKeys, spec.ExtraForeignKeys...)
 
 	// Construct the full table schema
 	schemaParts := []string{columns}
@@ -429,7 +983,7 @@ func getTableSchema(db *sql.DB, tableName string) (string, error) {
 	schemaParts = append(schemaParts, indexes...)
 	schemaParts = append(schemaParts, foreignKeys...)
 
-	return strings.Join(schemaParts, ", "), nil
+	return spec.renameSchemaColumns(strings.Join(schemaParts, ", ")), nil
 }
 
 func getColumnDefinitions(db *sql.DB, tableName string) (string, error) {
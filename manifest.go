@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Conflict policies for rows whose key already exists in the destination.
+const (
+	conflictFail      = "fail"
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictNewer     = "newer"
+)
+
+// updatedAtColumn decides which row wins under the "newer" conflict policy.
+const updatedAtColumn = "updated_at"
+
+// Manifest describes which tables are migrated, in which order, and how each
+// one is reshaped on its way to the destination database. Its roles section
+// describes the RBAC roles created once the tables are in place, and its
+// admins section how legacy admins are brought into them.
+type Manifest struct {
+	Tables []TableSpec  `json:"tables"`
+	Roles  RolesConfig  `json:"roles"`
+	Admins AdminsConfig `json:"admins"`
+}
+
+// TableSpec is the manifest entry for a single source table. KeyColumn names
+// the unique result column used to page reads and checkpoint progress; it
+// defaults to the source table's primary key when that is a single column
+// and no SourceQuery is set.
+// OnConflict overrides the -on-conflict policy for this table. Options holds
+// settings only a custom migrator understands.
+type TableSpec struct {
+	Name             string            `json:"name"`
+	Destination      string            `json:"destination,omitempty"`
+	SourceQuery      string            `json:"source_query,omitempty"`
+	Schema           string            `json:"schema,omitempty"`
+	RenameColumns    map[string]string `json:"rename_columns,omitempty"`
+	ExtraColumns     []string          `json:"extra_columns,omitempty"`
+	ExtraForeignKeys []string          `json:"extra_foreign_keys,omitempty"`
+	KeyColumn        string            `json:"key_column,omitempty"`
+	OnConflict       string            `json:"on_conflict,omitempty"`
+	Options          json.RawMessage   `json:"options,omitempty"`
+}
+
+func loadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest %s: %v", path, err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("error parsing manifest %s: %v", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for i, spec := range manifest.Tables {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("manifest %s: table entry %d has no name", path, i)
+		}
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("manifest %s: table %s is listed more than once", path, spec.Name)
+		}
+		seen[spec.Name] = true
+		if spec.OnConflict != "" && !validConflictPolicy(spec.OnConflict) {
+			return nil, fmt.Errorf("manifest %s: table %s has unknown on_conflict %q", path, spec.Name, spec.OnConflict)
+		}
+	}
+
+	if err := manifest.Roles.validate(); err != nil {
+		return nil, fmt.Errorf("manifest %s: %v", path, err)
+	}
+
+	return &manifest, nil
+}
+
+func validConflictPolicy(policy string) bool {
+	switch policy {
+	case conflictFail, conflictSkip, conflictOverwrite, conflictNewer:
+		return true
+	}
+	return false
+}
+
+// ConflictPolicy returns the table's conflict policy, falling back to the
+// run-wide default.
+func (t TableSpec) ConflictPolicy(defaultPolicy string) string {
+	if t.OnConflict != "" {
+		return t.OnConflict
+	}
+	return defaultPolicy
+}
+
+// DestinationTable returns the name of the table the rows are written to.
+func (t TableSpec) DestinationTable() string {
+	if t.Destination != "" {
+		return t.Destination
+	}
+	return t.Name
+}
+
+// SelectQuery returns the query used to read rows from the source table.
+func (t TableSpec) SelectQuery() string {
+	if t.SourceQuery != "" {
+		return t.SourceQuery
+	}
+	return fmt.Sprintf("SELECT * FROM %s", t.Name)
+}
+
+// RenameColumn maps a source column name to its destination name.
+func (t TableSpec) RenameColumn(column string) string {
+	if renamed, ok := t.RenameColumns[column]; ok {
+		return renamed
+	}
+	return column
+}
+
+func (t TableSpec) renameSchemaColumns(schema string) string {
+	for from, to := range t.RenameColumns {
+		schema = strings.ReplaceAll(schema, fmt.Sprintf("`%s`", from), fmt.Sprintf("`%s`", to))
+	}
+	return schema
+}
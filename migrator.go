@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// errSkipRow can be returned from TransformRow to leave a row out of the load.
+// A table that skipped rows fails, and verify reports it as a mismatch,
+// unless its migrator allows skipped rows.
+var errSkipRow = errors.New("skip row")
+
+// rowSkipper is implemented by migrators that can be configured to drop rows.
+type rowSkipper interface {
+	AllowSkippedRows() bool
+}
+
+func skippedRowsAllowed(migrator TableMigrator) bool {
+	skipper, ok := migrator.(rowSkipper)
+	return ok && skipper.AllowSkippedRows()
+}
+
+// TableMigrator controls how one source table is copied to the destination.
+// migrateTable calls the hooks in order: Schema, SourceQuery,
+// DestinationColumns, TransformRow for every row, then PostLoad.
+type TableMigrator interface {
+	Spec() TableSpec
+	Schema(sourceDB *sql.DB) (string, error)
+	SourceQuery() string
+	DestinationColumns(sourceColumns []string) []string
+	TransformRow(values []interface{}) ([]interface{}, error)
+	PostLoad(sourceDB, destDB *sql.DB) error
+}
+
+type migratorFactory func(spec TableSpec) TableMigrator
+
+var migratorRegistry = map[string]migratorFactory{}
+
+// registerMigrator makes a custom migrator available for a source table.
+// It is meant to be called from init functions.
+func registerMigrator(tableName string, factory migratorFactory) {
+	if _, exists := migratorRegistry[tableName]; exists {
+		panic(fmt.Sprintf("migrator already registered for table %s", tableName))
+	}
+	migratorRegistry[tableName] = factory
+}
+
+func newTableMigrator(spec TableSpec) TableMigrator {
+	if factory, ok := migratorRegistry[spec.Name]; ok {
+		return factory(spec)
+	}
+	return newManifestMigrator(spec)
+}
+
+// manifestMigrator copies a table exactly as described by its manifest entry.
+// Custom migrators embed it and override only the hooks they need.
+type manifestMigrator struct {
+	spec TableSpec
+}
+
+func newManifestMigrator(spec TableSpec) *manifestMigrator {
+	return &manifestMigrator{spec: spec}
+}
+
+func (m *manifestMigrator) Spec() TableSpec {
+	return m.spec
+}
+
+func (m *manifestMigrator) Schema(sourceDB *sql.DB) (string, error) {
+	if m.spec.Schema != "" {
+		return m.spec.Schema, nil
+	}
+	return getTableSchema(sourceDB, m.spec)
+}
+
+func (m *manifestMigrator) SourceQuery() string {
+	return m.spec.SelectQuery()
+}
+
+func (m *manifestMigrator) DestinationColumns(sourceColumns []string) []string {
+	columns := make([]string, len(sourceColumns))
+	for i, col := range sourceColumns {
+		columns[i] = m.spec.RenameColumn(col)
+	}
+	return columns
+}
+
+func (m *manifestMigrator) TransformRow(values []interface{}) ([]interface{}, error) {
+	return values, nil
+}
+
+func (m *manifestMigrator) PostLoad(sourceDB, destDB *sql.DB) error {
+	return nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerMigrator("audit_logs", newAuditLogsMigrator)
+}
+
+// auditLogColumns is the shape of every row written to audit_log.
+var auditLogColumns = []string{"id", "actor", "operation", "entity_type", "actor_type", "entity_id", "modified_date", "entity_info", "old_value", "new_value"}
+
+// auditSourceColumns lists, for each audit_log column, the source columns it
+// may be read from. Destination names come first so a source_query that
+// already aliases its columns works as well as the legacy names.
+var auditSourceColumns = map[string][]string{
+	"id":            {"id"},
+	"actor":         {"actor"},
+	"operation":     {"operation", "action"},
+	"entity_type":   {"entity_type", "target"},
+	"actor_type":    {"actor_type"},
+	"entity_id":     {"entity_id", "target_id"},
+	"modified_date": {"modified_date", "created_at"},
+	"entity_info":   {"entity_info", "target_info"},
+}
+
+// Actor types written to audit_log.
+const (
+	actorTypeAdmin   = "ADMIN"
+	actorTypeUser    = "USER"
+	actorTypeUnknown = "UNKNOWN"
+)
+
+// Fallbacks for actors that cannot be resolved to an admin email.
+const (
+	// unresolvedActorAdminID records the raw admin_id of a deleted admin.
+	unresolvedActorAdminID = "admin_id"
+	// unresolvedActorTombstone records the tombstone marker instead.
+	unresolvedActorTombstone = "tombstone"
+)
+
+// defaultAuditOperations maps common legacy action strings to operations.
+var defaultAuditOperations = map[string]string{
+	"ADD":     "ADD",
+	"CREATE":  "ADD",
+	"CREATED": "ADD",
+	"INSERT":  "ADD",
+	"DELETE":  "DELETE",
+	"DELETED": "DELETE",
+	"REMOVE":  "DELETE",
+	"REMOVED": "DELETE",
+	"UPDATE":  "UPDATE",
+	"UPDATED": "UPDATE",
+	"EDIT":    "UPDATE",
+	"MODIFY":  "UPDATE",
+}
+
+// auditLogOptions are read from the options of the audit_logs manifest entry.
+// Legacy actions are matched case-insensitively. Actions missing from the
+// mapping get FallbackOperation, or are skipped when it is empty; both cases
+// are counted in Report per action, admin and reason. Skipped rows fail the
+// table, and count as a mismatch in verify, unless AllowSkippedRows is set.
+// OldValueColumn and NewValueColumn name the legacy payload columns copied
+// into old_value and new_value when the source has them.
+//
+// Rows with an admin email are ADMIN actions. Rows without an admin but with
+// a value in UserIDColumn are USER actions by that user. For the rest,
+// UnresolvedActor picks between the raw admin ID and TombstoneActor; these
+// rows are counted and reported as unresolved.
+type auditLogOptions struct {
+	OperationMapping  map[string]string `json:"operation_mapping,omitempty"`
+	FallbackOperation string            `json:"fallback_operation,omitempty"`
+	AllowSkippedRows  bool              `json:"allow_skipped_rows,omitempty"`
+	OldValueColumn    string            `json:"old_value_column,omitempty"`
+	NewValueColumn    string            `json:"new_value_column,omitempty"`
+	AdminIDColumn     string            `json:"admin_id_column,omitempty"`
+	UserIDColumn      string            `json:"user_id_column,omitempty"`
+	UnresolvedActor   string            `json:"unresolved_actor,omitempty"`
+	TombstoneActor    string            `json:"tombstone_actor,omitempty"`
+	Report            string            `json:"report,omitempty"`
+}
+
+// auditLogsMigrator reshapes the legacy audit_logs rows into the audit_log
+// table of the new service.
+type auditLogsMigrator struct {
+	*manifestMigrator
+	options    auditLogOptions
+	operations map[string]string
+	err        error
+
+	// sourceIndex maps each audit_log column to its source column, or -1.
+	sourceIndex []int
+	adminIndex  int
+	userIndex   int
+
+	// issues aggregates the reported rows by action, admin and reason, so
+	// the report stays bounded however many rows are affected.
+	issues           map[string]*auditIssue
+	issueOrder       []string
+	issueRows        int
+	unresolvedActors int
+}
+
+// auditIssue is one line of the audit log report.
+type auditIssue struct {
+	values  []string
+	rows    int
+	firstID string
+}
+
+func newAuditLogsMigrator(spec TableSpec) TableMigrator {
+	m := &auditLogsMigrator{
+		manifestMigrator: newManifestMigrator(spec),
+		options: auditLogOptions{
+			OldValueColumn:  "old_value",
+			NewValueColumn:  "new_value",
+			AdminIDColumn:   "admin_id",
+			UserIDColumn:    "user_id",
+			UnresolvedActor: unresolvedActorAdminID,
+			TombstoneActor:  "deleted-admin",
+			Report:          "audit-log-report.csv",
+		},
+		issues: make(map[string]*auditIssue),
+	}
+	if len(spec.Options) > 0 {
+		if err := json.Unmarshal(spec.Options, &m.options); err != nil {
+			m.err = fmt.Errorf("invalid options for table %s: %v", spec.Name, err)
+		}
+	}
+	m.operations, m.err = auditOperations(m.options, m.err)
+	if m.err == nil && m.options.UnresolvedActor != unresolvedActorAdminID && m.options.UnresolvedActor != unresolvedActorTombstone {
+		m.err = fmt.Errorf("invalid options for table %s: unresolved_actor %q must be admin_id or tombstone", spec.Name, m.options.UnresolvedActor)
+	}
+	return m
+}
+
+// auditOperations merges the configured mapping over the defaults and checks
+// that it only produces operations the audit_log enum accepts.
+func auditOperations(options auditLogOptions, err error) (map[string]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	operations := make(map[string]string, len(defaultAuditOperations)+len(options.OperationMapping))
+	for action, operation := range defaultAuditOperations {
+		operations[action] = operation
+	}
+	for action, operation := range options.OperationMapping {
+		operations[strings.ToUpper(action)] = operation
+	}
+	targets := []string{options.FallbackOperation}
+	for _, operation := range operations {
+		targets = append(targets, operation)
+	}
+	for _, operation := range targets {
+		switch operation {
+		case "", "ADD", "DELETE", "UPDATE":
+		default:
+			return nil, fmt.Errorf("audit operation %q is not one of ADD, DELETE or UPDATE", operation)
+		}
+	}
+	return operations, nil
+}
+
+func (m *auditLogsMigrator) Schema(sourceDB *sql.DB) (string, error) {
+	if m.err != nil {
+		return "", m.err
+	}
+	return m.manifestMigrator.Schema(sourceDB)
+}
+
+// DestinationFilter leaves out the entries the migration writes for itself.
+func (m *auditLogsMigrator) DestinationFilter() string {
+	return fmt.Sprintf("actor_type <> '%s'", actorTypeSystem)
+}
+
+// AllowSkippedRows reports whether rows with unmapped actions may be dropped.
+func (m *auditLogsMigrator) AllowSkippedRows() bool {
+	return m.options.AllowSkippedRows
+}
+
+func (m *auditLogsMigrator) DestinationColumns(sourceColumns []string) []string {
+	position := make(map[string]int, len(sourceColumns))
+	for i, col := range sourceColumns {
+		if _, seen := position[col]; !seen {
+			position[col] = i
+		}
+	}
+	candidates := make(map[string][]string, len(auditSourceColumns)+2)
+	for col, names := range auditSourceColumns {
+		candidates[col] = names
+	}
+	candidates["old_value"] = []string{m.options.OldValueColumn}
+	candidates["new_value"] = []string{m.options.NewValueColumn}
+
+	m.sourceIndex = make([]int, len(auditLogColumns))
+	for i, col := range auditLogColumns {
+		m.sourceIndex[i] = -1
+		for _, name := range candidates[col] {
+			if index, ok := position[name]; ok {
+				m.sourceIndex[i] = index
+				break
+			}
+		}
+	}
+	m.adminIndex, m.userIndex = -1, -1
+	if index, ok := position[m.options.AdminIDColumn]; ok {
+		m.adminIndex = index
+	}
+	if index, ok := position[m.options.UserIDColumn]; ok {
+		m.userIndex = index
+	}
+	return auditLogColumns
+}
+
+func (m *auditLogsMigrator) TransformRow(values []interface{}) ([]interface{}, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	row := make([]interface{}, len(auditLogColumns))
+	for i, index := range m.sourceIndex {
+		if index >= 0 {
+			row[i] = values[index]
+		}
+	}
+
+	id := auditText(row[0])
+	action := auditText(row[2])
+	operation, ok := m.operations[strings.ToUpper(strings.TrimSpace(action))]
+	if !ok {
+		if m.options.FallbackOperation == "" {
+			m.addIssue(id, action, "", m.sourceText(values, m.adminIndex), "", "action has no operation mapping; row skipped")
+			return nil, errSkipRow
+		}
+		operation = m.options.FallbackOperation
+		m.addIssue(id, action, operation, m.sourceText(values, m.adminIndex), "", "action has no operation mapping; fallback used")
+	}
+	row[2] = operation
+
+	if reason := m.resolveActor(values, row); reason != "" {
+		m.unresolvedActors++
+		m.addIssue(id, action, operation, m.sourceText(values, m.adminIndex), auditText(row[4]), reason)
+	}
+
+	for _, i := range []int{8, 9} {
+		if row[i] != nil {
+			row[i] = auditJSON(row[i])
+		}
+	}
+	return row, nil
+}
+
+// resolveActor fills the actor and actor_type of a row. It returns why the
+// actor could not be resolved, or "" when it was.
+func (m *auditLogsMigrator) resolveActor(values, row []interface{}) string {
+	adminId := m.sourceText(values, m.adminIndex)
+	userId := m.sourceText(values, m.userIndex)
+
+	switch {
+	case auditText(row[1]) != "":
+		if row[4] == nil {
+			row[4] = actorTypeAdmin
+		}
+		return ""
+	case adminId == "" && userId != "":
+		row[1], row[4] = userId, actorTypeUser
+		return ""
+	case adminId != "":
+		row[1], row[4] = adminId, actorTypeAdmin
+		if m.options.UnresolvedActor == unresolvedActorTombstone {
+			row[1] = m.options.TombstoneActor
+		}
+		return "admin no longer exists"
+	default:
+		row[1], row[4] = m.options.TombstoneActor, actorTypeUnknown
+		return "row has neither an admin nor a user"
+	}
+}
+
+// addIssue counts a reported row against its action, admin and reason.
+func (m *auditLogsMigrator) addIssue(id, action, operation, adminId, actorType, reason string) {
+	values := []string{action, operation, adminId, actorType, reason}
+	key := strings.Join(values, "\x00")
+	issue, ok := m.issues[key]
+	if !ok {
+		issue = &auditIssue{values: values, firstID: id}
+		m.issues[key] = issue
+		m.issueOrder = append(m.issueOrder, key)
+	}
+	issue.rows++
+	m.issueRows++
+}
+
+func (m *auditLogsMigrator) sourceText(values []interface{}, index int) string {
+	if index < 0 {
+		return ""
+	}
+	return strings.TrimSpace(auditText(values[index]))
+}
+
+func (m *auditLogsMigrator) PostLoad(sourceDB, destDB *sql.DB) error {
+	log.Printf("Audit log actors: %d unresolved (recorded as %s).", m.unresolvedActors, m.options.UnresolvedActor)
+	if m.issueRows == 0 {
+		return nil
+	}
+	report := newReport("action", "operation", "admin_id", "actor_type", "reason", "rows", "first_id")
+	for _, key := range m.issueOrder {
+		issue := m.issues[key]
+		report.Add(append(issue.values, strconv.Itoa(issue.rows), issue.firstID)...)
+	}
+	log.Printf("%d audit log rows had an unmapped action or unresolved actor; see %s", m.issueRows, m.options.Report)
+	return report.Write(m.options.Report)
+}
+
+func auditText(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// auditJSON returns a legacy payload as JSON: valid JSON is kept as it is,
+// anything else is encoded as a JSON string.
+func auditJSON(value interface{}) string {
+	text := auditText(value)
+	if json.Valid([]byte(text)) {
+		return text
+	}
+	encoded, _ := json.Marshal(text)
+	return string(encoded)
+}
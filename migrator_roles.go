@@ -0,0 +1,20 @@
+package main
+
+func init() {
+	registerMigrator("roles", newRolesMigrator)
+}
+
+// rolesMigrator copies the legacy roles table, whose rows are then replaced
+// or joined by the RBAC roles created by insertRolesForTeams.
+type rolesMigrator struct {
+	*manifestMigrator
+}
+
+func newRolesMigrator(spec TableSpec) TableMigrator {
+	return &rolesMigrator{newManifestMigrator(spec)}
+}
+
+// SkipVerification explains why verify leaves the roles table out.
+func (m *rolesMigrator) SkipVerification() string {
+	return "rewritten with RBAC roles after the copy"
+}
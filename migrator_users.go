@@ -0,0 +1,24 @@
+package main
+
+import "fmt"
+
+func init() {
+	registerMigrator("users", newUsersMigrator)
+}
+
+// usersMigrator copies the users table, which -migrate-admins may extend
+// with users created for legacy admins.
+type usersMigrator struct {
+	*manifestMigrator
+}
+
+func newUsersMigrator(spec TableSpec) TableMigrator {
+	return &usersMigrator{newManifestMigrator(spec)}
+}
+
+// DestinationFilter leaves out the users created for admins, which the audit
+// trail records.
+func (m *usersMigrator) DestinationFilter() string {
+	return fmt.Sprintf("id NOT IN (SELECT entity_id FROM audit_log WHERE actor_type = '%s' AND entity_type = '%s')",
+		actorTypeSystem, auditEntityUser)
+}
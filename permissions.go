@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// PermissionCatalog lists the permissions of the new service and which roles
+// hold them. Role permissions are written as "resource:action".
+type PermissionCatalog struct {
+	Permissions     []Permission        `json:"permissions"`
+	RolePermissions map[string][]string `json:"role_permissions"`
+}
+
+// Permission is a single action on a resource.
+type Permission struct {
+	Resource    string `json:"resource"`
+	Action      string `json:"action"`
+	Description string `json:"description,omitempty"`
+}
+
+func (p Permission) key() string {
+	return p.Resource + ":" + p.Action
+}
+
+func loadPermissionCatalog(path string) (*PermissionCatalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading permission catalog %s: %v", path, err)
+	}
+
+	var catalog PermissionCatalog
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("error parsing permission catalog %s: %v", path, err)
+	}
+
+	known := make(map[string]bool)
+	for _, permission := range catalog.Permissions {
+		if permission.Resource == "" || permission.Action == "" {
+			return nil, fmt.Errorf("permission catalog %s: permission %q needs both a resource and an action", path, permission.key())
+		}
+		if known[permission.key()] {
+			return nil, fmt.Errorf("permission catalog %s: permission %s is listed more than once", path, permission.key())
+		}
+		known[permission.key()] = true
+	}
+	for role, keys := range catalog.RolePermissions {
+		for _, key := range keys {
+			if !known[key] {
+				return nil, fmt.Errorf("permission catalog %s: role %s refers to unknown permission %s", path, role, key)
+			}
+		}
+	}
+
+	return &catalog, nil
+}
+
+// permissionID derives a stable ID for a permission, like roleID does for roles.
+func permissionID(namespace uuid.UUID, permission Permission) string {
+	return uuid.NewSHA1(namespace, []byte("permission/"+permission.key())).String()
+}
+
+func ensurePermissionTablesExist(db *sql.DB) error {
+	createPermissionsQuery := `
+    CREATE TABLE IF NOT EXISTS permissions (
+        id CHAR(36) NOT NULL,
+        resource VARCHAR(255) NOT NULL,
+        action VARCHAR(255) NOT NULL,
+        description VARCHAR(255) NULL,
+        PRIMARY KEY (id),
+        UNIQUE KEY uk_permissions_resource_action (resource, action)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`
+	if _, err := db.Exec(createPermissionsQuery); err != nil {
+		return fmt.Errorf("error creating permissions table: %v", err)
+	}
+
+	createMappingQuery := `
+    CREATE TABLE IF NOT EXISTS role_permissions_mapping (
+        role_id CHAR(36) NOT NULL,
+        permission_id CHAR(36) NOT NULL,
+        PRIMARY KEY (role_id, permission_id),
+        FOREIGN KEY (role_id) REFERENCES roles(id),
+        FOREIGN KEY (permission_id) REFERENCES permissions(id)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`
+	if _, err := db.Exec(createMappingQuery); err != nil {
+		return fmt.Errorf("error creating role_permissions_mapping table: %v", err)
+	}
+
+	log.Println("Ensured permissions and role_permissions_mapping tables exist.")
+	return nil
+}
+
+// seedPermissions writes the catalog's permissions and syncs the grants of
+// the roles the templates describe with the catalog: permissions listed for
+// the role's name are granted and any others are revoked. Only the template
+// roles' derived IDs are managed, so CUSTOM roles and roles the templates do
+// not produce, such as legacy roles of the same name, are left alone.
+// Permission IDs are read back from the table, since a permission keeps the
+// ID it was first created with when -role-namespace changes.
+func seedPermissions(db *sql.DB, namespace uuid.UUID, config RolesConfig, catalog *PermissionCatalog) error {
+	scope, err := fetchRoleScope(db, config)
+	if err != nil {
+		return err
+	}
+	existing, err := fetchExistingRoles(db)
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool, len(existing))
+	for _, role := range existing {
+		present[role.ID] = true
+	}
+	managed := make(map[string]string)
+	for _, role := range desiredRoles(namespace, config.RoleTemplates(), scope) {
+		if role.Type != "CUSTOM" && present[role.ID] {
+			managed[role.ID] = role.Name
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	permissionStmt, err := tx.Prepare(`INSERT INTO permissions (id, resource, action, description) VALUES (?, ?, ?, ?)
+              ON DUPLICATE KEY UPDATE description = VALUES(description)`)
+	if err != nil {
+		return fmt.Errorf("error preparing permission insert statement: %v", err)
+	}
+	defer permissionStmt.Close()
+
+	for _, permission := range catalog.Permissions {
+		if _, err := permissionStmt.Exec(permissionID(namespace, permission), permission.Resource, permission.Action, permission.Description); err != nil {
+			return fmt.Errorf("error inserting permission %s: %v", permission.key(), err)
+		}
+	}
+
+	ids, err := fetchPermissionIDs(tx)
+	if err != nil {
+		return err
+	}
+	desired := make(map[string]bool)
+	for roleId, name := range managed {
+		for _, key := range catalog.RolePermissions[name] {
+			desired[roleId+"/"+ids[key]] = true
+		}
+	}
+
+	granted, revoked, err := syncRolePermissions(tx, managed, desired, catalog.RolePermissions, ids)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for role, keys := range catalog.RolePermissions {
+		log.Printf("Role %s holds %d permissions: %s", role, len(keys), strings.Join(keys, ", "))
+	}
+	log.Printf("Seeded %d permissions for %d roles: %d role permission mappings added, %d revoked.", len(catalog.Permissions), len(managed), granted, revoked)
+	return nil
+}
+
+// fetchPermissionIDs returns the ID of every permission by "resource:action".
+func fetchPermissionIDs(tx *sql.Tx) (map[string]string, error) {
+	rows, err := tx.Query("SELECT id, resource, action FROM permissions")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching permissions: %v", err)
+	}
+	defer rows.Close()
+
+	ids := make(map[string]string)
+	for rows.Next() {
+		var id string
+		var permission Permission
+		if err := rows.Scan(&id, &permission.Resource, &permission.Action); err != nil {
+			return nil, fmt.Errorf("error scanning permission: %v", err)
+		}
+		ids[permission.key()] = id
+	}
+	return ids, rows.Err()
+}
+
+// syncRolePermissions makes the grants of the managed roles, keyed by role ID,
+// match desired, which is keyed by role ID and permission ID. Grants of other
+// roles are not read or changed.
+func syncRolePermissions(tx *sql.Tx, managed map[string]string, desired map[string]bool, rolePermissions map[string][]string, ids map[string]string) (granted, revoked int64, err error) {
+	rows, err := tx.Query("SELECT role_id, permission_id FROM role_permissions_mapping")
+	if err != nil {
+		return 0, 0, fmt.Errorf("error fetching role permission mappings: %v", err)
+	}
+	defer rows.Close()
+
+	held := make(map[string]bool)
+	var stale [][2]string
+	for rows.Next() {
+		var roleId, permissionId string
+		if err := rows.Scan(&roleId, &permissionId); err != nil {
+			return 0, 0, fmt.Errorf("error scanning role permission mapping: %v", err)
+		}
+		if _, ok := managed[roleId]; !ok {
+			continue
+		}
+		held[roleId+"/"+permissionId] = true
+		if !desired[roleId+"/"+permissionId] {
+			stale = append(stale, [2]string{roleId, permissionId})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	rows.Close()
+
+	for _, grant := range stale {
+		if _, err := tx.Exec("DELETE FROM role_permissions_mapping WHERE role_id = ? AND permission_id = ?", grant[0], grant[1]); err != nil {
+			return 0, 0, fmt.Errorf("error revoking permission %s from role %s: %v", grant[1], grant[0], err)
+		}
+	}
+
+	grantStmt, err := tx.Prepare("INSERT INTO role_permissions_mapping (role_id, permission_id) VALUES (?, ?)")
+	if err != nil {
+		return 0, 0, fmt.Errorf("error preparing role permission insert statement: %v", err)
+	}
+	defer grantStmt.Close()
+
+	for roleId, name := range managed {
+		for _, key := range rolePermissions[name] {
+			if held[roleId+"/"+ids[key]] {
+				continue
+			}
+			if _, err := grantStmt.Exec(roleId, ids[key]); err != nil {
+				return 0, 0, fmt.Errorf("error granting %s to role %s: %v", key, roleId, err)
+			}
+			held[roleId+"/"+ids[key]] = true
+			granted++
+		}
+	}
+	return granted, int64(len(stale)), nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// migrationPlan is the JSON summary written by the plan command.
+type migrationPlan struct {
+	Tables        []tablePlan   `json:"tables"`
+	Roles         []plannedRole `json:"roles"`
+	EstimatedRows int64         `json:"estimated_rows"`
+}
+
+type tablePlan struct {
+	Source        string `json:"source"`
+	Destination   string `json:"destination"`
+	CreateTable   string `json:"create_table"`
+	SourceQuery   string `json:"source_query"`
+	EstimatedRows int64  `json:"estimated_rows"`
+}
+
+// runPlan builds the DDL, source queries and role rows a migration would use
+// and writes them to <outPrefix>.sql and <outPrefix>.json. It only reads from
+// the source database and never connects to the destination.
+func runPlan(sourceDB *sql.DB, manifest *Manifest, opts migrationOptions, outPrefix string) error {
+	var plan migrationPlan
+	var script strings.Builder
+
+	for _, spec := range manifest.Tables {
+		migrator := newTableMigrator(spec)
+		schema, err := migrator.Schema(sourceDB)
+		if err != nil {
+			return fmt.Errorf("error getting schema for table %s: %v", spec.Name, err)
+		}
+		estimate, err := estimateRowCount(sourceDB, spec.Name)
+		if err != nil {
+			return fmt.Errorf("error estimating row count for table %s: %v", spec.Name, err)
+		}
+
+		table := tablePlan{
+			Source:        spec.Name,
+			Destination:   spec.DestinationTable(),
+			CreateTable:   createTableStatement(spec.DestinationTable(), schema),
+			SourceQuery:   migrator.SourceQuery(),
+			EstimatedRows: estimate,
+		}
+		plan.Tables = append(plan.Tables, table)
+		plan.EstimatedRows += estimate
+
+		fmt.Fprintf(&script, "-- %s -> %s (~%d rows)\n", table.Source, table.Destination, table.EstimatedRows)
+		fmt.Fprintf(&script, "%s;\n", table.CreateTable)
+		script.WriteString("-- Source query:\n")
+		for _, line := range strings.Split(table.SourceQuery, "\n") {
+			fmt.Fprintf(&script, "--   %s\n", strings.TrimSpace(line))
+		}
+		script.WriteString("\n")
+	}
+
+	roles, err := planRoles(sourceDB, opts.RoleNamespace, manifest.Roles)
+	if err != nil {
+		return err
+	}
+	plan.Roles = roles
+
+	script.WriteString("-- Roles created by insertRolesForTeams\n")
+	for _, role := range roles {
+		teamId := "NULL"
+		if role.TeamID != nil {
+			teamId = sqlQuote(*role.TeamID)
+		}
+		fmt.Fprintf(&script, "INSERT INTO roles (id, name, type, team_id, billing_id) VALUES (%s, %s, %s, %s, %s);\n",
+			sqlQuote(role.ID), sqlQuote(role.Name), sqlQuote(role.Type), teamId, sqlQuote(role.BillingID))
+	}
+	script.WriteString("\n")
+	fmt.Fprintf(&script, "%s\n", strings.TrimSpace(userRolesMappingTableQuery))
+
+	summary, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding plan summary: %v", err)
+	}
+	if err := os.WriteFile(outPrefix+".sql", []byte(script.String()), 0644); err != nil {
+		return fmt.Errorf("error writing plan script: %v", err)
+	}
+	if err := os.WriteFile(outPrefix+".json", append(summary, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing plan summary: %v", err)
+	}
+
+	log.Printf("Wrote migration plan for %d tables (~%d rows) and %d roles to %s.sql and %s.json",
+		len(plan.Tables), plan.EstimatedRows, len(plan.Roles), outPrefix, outPrefix)
+	return nil
+}
+
+// planRoles computes the roles insertRolesForTeams would create, reading the
+// billing accounts, teams and plans from the source database since the destination copy may not exist yet.
+func planRoles(sourceDB *sql.DB, namespace uuid.UUID, config RolesConfig) ([]plannedRole, error) {
+	scope, err := fetchRoleScope(sourceDB, config)
+	if err != nil {
+		return nil, err
+	}
+	return desiredRoles(namespace, config.RoleTemplates(), scope), nil
+}
+
+// estimateRowCount returns InnoDB's row estimate for a table, which avoids a
+// full COUNT(*) scan on large tables.
+func estimateRowCount(db *sql.DB, tableName string) (int64, error) {
+	var estimate sql.NullInt64
+	err := db.QueryRow(`SELECT TABLE_ROWS FROM INFORMATION_SCHEMA.TABLES
+              WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?`, tableName).Scan(&estimate)
+	if err != nil {
+		return 0, err
+	}
+	return estimate.Int64, nil
+}
+
+// readOnlyDSN makes every connection opened with the DSN read-only.
+func readOnlyDSN(dsn string) string {
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	return dsn + separator + "transaction_read_only=1"
+}
+
+func sqlQuote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
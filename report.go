@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// report collects rows for a CSV or JSON file. The format is picked from the
+// file extension when it is written: ".json" gives an array of objects keyed
+// by column, anything else gives CSV with a header row.
+type report struct {
+	mu      sync.Mutex
+	columns []string
+	rows    [][]string
+}
+
+func newReport(columns ...string) *report {
+	return &report{columns: columns}
+}
+
+// Add appends a row; values are matched to the columns by position.
+func (r *report) Add(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rows = append(r.rows, values)
+}
+
+// Len returns the number of rows added so far.
+func (r *report) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.rows)
+}
+
+// Count returns the number of rows whose column has the given value.
+func (r *report) Count(column, value string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	index := -1
+	for i, col := range r.columns {
+		if col == column {
+			index = i
+		}
+	}
+	count := 0
+	for _, row := range r.rows {
+		if index >= 0 && index < len(row) && row[index] == value {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *report) Write(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating report %s: %v", path, err)
+	}
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		records := make([]map[string]string, len(r.rows))
+		for i, row := range r.rows {
+			record := make(map[string]string, len(r.columns))
+			for j, col := range r.columns {
+				if j < len(row) {
+					record[col] = row[j]
+				}
+			}
+			records[i] = record
+		}
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(records); err != nil {
+			return fmt.Errorf("error writing report %s: %v", path, err)
+		}
+		return file.Close()
+	}
+
+	writer := csv.NewWriter(file)
+	writer.Write(r.columns)
+	writer.WriteAll(r.rows)
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("error writing report %s: %v", path, err)
+	}
+	return file.Close()
+}
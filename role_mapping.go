@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// defaultRoleNameMapping is used when the manifest has no name_mapping.
+var defaultRoleNameMapping = map[string][]string{
+	"USER":       {"PLATFORM_READ_ONLY"},
+	"TEAM_ADMIN": {"PLATFORM_ADMIN"},
+	"BI_ADMIN":   {"BI_ADMIN"},
+}
+
+// RoleNameMapping returns the configured legacy to destination role mapping
+// or the defaults.
+func (c RolesConfig) RoleNameMapping() map[string][]string {
+	if len(c.NameMapping) > 0 {
+		return c.NameMapping
+	}
+	return defaultRoleNameMapping
+}
+
+// checkRoleNameMapping lists every legacy role name in use that the mapping
+// does not cover, with the number of users holding it. In strict mode any
+// such role aborts the run before a single assignment is made.
+func checkRoleNameMapping(sourceDB *sql.DB, mapping map[string][]string, strict bool) error {
+	rows, err := sourceDB.Query(`SELECT r.name, COUNT(DISTINCT ur.user_id)
+              FROM users_role ur
+              JOIN roles r ON ur.role_id = r.id
+              GROUP BY r.name`)
+	if err != nil {
+		return fmt.Errorf("error counting users per legacy role: %v", err)
+	}
+	defer rows.Close()
+
+	unmapped := make(map[string]int)
+	for rows.Next() {
+		var name string
+		var users int
+		if err := rows.Scan(&name, &users); err != nil {
+			return fmt.Errorf("error scanning legacy role count: %v", err)
+		}
+		if _, ok := mapping[name]; !ok {
+			unmapped[name] = users
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(unmapped) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(unmapped))
+	for name := range unmapped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("Legacy role %s is not in the role name mapping (%d users)", name, unmapped[name])
+	}
+
+	if strict {
+		return fmt.Errorf("%d legacy roles are not in the role name mapping", len(unmapped))
+	}
+	log.Printf("Unmapped legacy roles will be looked up under their own name.")
+	return nil
+}
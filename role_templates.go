@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Role template scopes.
+const (
+	scopeBilling = "billing"
+	scopeTeam    = "team"
+)
+
+// defaultPlanQuery maps each billing account to its plan. It must return two
+// columns: the billing account ID and the plan the templates' plans refer to.
+const defaultPlanQuery = "SELECT billing_id, plan_id FROM tenant_plan_table"
+
+// RolesConfig is the roles section of the manifest.
+type RolesConfig struct {
+	Templates        []RoleTemplate      `json:"templates,omitempty"`
+	PlanQuery        string              `json:"plan_query,omitempty"`
+	NameMapping      map[string][]string `json:"name_mapping,omitempty"`
+	PrimaryTeamQuery string              `json:"primary_team_query,omitempty"`
+}
+
+// RoleTemplate describes a role created for every billing account or every
+// team. When Plans is set, the role is only created for billing accounts (and
+// the teams of billing accounts) on one of those plans.
+type RoleTemplate struct {
+	Name  string   `json:"name"`
+	Type  string   `json:"type"`
+	Scope string   `json:"scope"`
+	Plans []string `json:"plans,omitempty"`
+}
+
+// defaultRoleTemplates are used when the manifest has no role templates.
+var defaultRoleTemplates = []RoleTemplate{
+	{Name: "BI_ADMIN", Type: "BILLING", Scope: scopeBilling},
+	{Name: "PLATFORM_ADMIN", Type: "STANDARD", Scope: scopeTeam},
+	{Name: "PLATFORM_READ_ONLY", Type: "STANDARD", Scope: scopeTeam},
+}
+
+// RoleTemplates returns the configured templates or the defaults.
+func (c RolesConfig) RoleTemplates() []RoleTemplate {
+	if len(c.Templates) > 0 {
+		return c.Templates
+	}
+	return defaultRoleTemplates
+}
+
+func (c RolesConfig) planQuery() string {
+	if c.PlanQuery != "" {
+		return c.PlanQuery
+	}
+	return defaultPlanQuery
+}
+
+func (c RolesConfig) usesPlans() bool {
+	for _, template := range c.RoleTemplates() {
+		if len(template.Plans) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// billingScopedRoles returns the names of the roles that are created per
+// billing account rather than per team.
+func (c RolesConfig) billingScopedRoles() map[string]bool {
+	names := make(map[string]bool)
+	for _, template := range c.RoleTemplates() {
+		if template.Scope == scopeBilling {
+			names[template.Name] = true
+		}
+	}
+	return names
+}
+
+func (c RolesConfig) validate() error {
+	seen := make(map[string]bool)
+	for i, template := range c.Templates {
+		if template.Name == "" {
+			return fmt.Errorf("role template %d has no name", i)
+		}
+		switch template.Type {
+		case "BILLING", "STANDARD", "CUSTOM":
+		default:
+			return fmt.Errorf("role template %s has unknown type %q", template.Name, template.Type)
+		}
+		if template.Scope != scopeBilling && template.Scope != scopeTeam {
+			return fmt.Errorf("role template %s has unknown scope %q", template.Name, template.Scope)
+		}
+		key := template.Scope + "/" + template.Name
+		if seen[key] {
+			return fmt.Errorf("role template %s is defined more than once for scope %s", template.Name, template.Scope)
+		}
+		seen[key] = true
+	}
+	for legacy, names := range c.NameMapping {
+		if len(names) == 0 {
+			return fmt.Errorf("role name mapping for %s lists no destination roles", legacy)
+		}
+	}
+	return nil
+}
+
+// appliesTo reports whether the template's plan condition accepts a plan.
+func (t RoleTemplate) appliesTo(plan string) bool {
+	if len(t.Plans) == 0 {
+		return true
+	}
+	for _, p := range t.Plans {
+		if p == plan {
+			return true
+		}
+	}
+	return false
+}
+
+// roleScope holds the billing accounts, teams and plans templates expand to.
+type roleScope struct {
+	BillingIDs []string
+	Teams      []teamRef
+	Plans      map[string]string
+}
+
+// fetchRoleScope reads the data needed to expand the role templates. Plans
+// are only queried when a template has a plan condition.
+func fetchRoleScope(db *sql.DB, config RolesConfig) (roleScope, error) {
+	var scope roleScope
+	var err error
+	if scope.BillingIDs, err = fetchBillingAccounts(db); err != nil {
+		return scope, err
+	}
+	if scope.Teams, err = fetchTeams(db); err != nil {
+		return scope, err
+	}
+	if config.usesPlans() {
+		if scope.Plans, err = fetchBillingPlans(db, config.planQuery()); err != nil {
+			return scope, err
+		}
+	}
+	return scope, nil
+}
+
+func fetchBillingPlans(db *sql.DB, query string) (map[string]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching billing plans: %v", err)
+	}
+	defer rows.Close()
+
+	plans := make(map[string]string)
+	for rows.Next() {
+		var billingId string
+		var plan sql.NullString
+		if err := rows.Scan(&billingId, &plan); err != nil {
+			return nil, fmt.Errorf("error scanning billing plan: %v", err)
+		}
+		plans[billingId] = plan.String
+	}
+	return plans, rows.Err()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+// Modes for creating roles in the destination.
+const (
+	// rolesModeReplace deletes every role and recreates the desired set.
+	rolesModeReplace = "replace"
+	// rolesModeReconcile only inserts missing roles and reports extra ones.
+	rolesModeReconcile = "reconcile"
+)
+
+// existingRole is a row already present in the destination roles table.
+type existingRole struct {
+	ID        string
+	Name      string
+	Type      string
+	TeamID    sql.NullString
+	BillingID sql.NullString
+}
+
+// reconcileRolesForTeams inserts the desired roles that are missing from the
+// destination without deleting anything. Roles are matched on name, team and
+// billing account so roles created with other IDs by earlier runs are kept.
+// Non-CUSTOM roles outside the desired set are reported; CUSTOM roles are
+// never touched.
+func reconcileRolesForTeams(db *sql.DB, namespace uuid.UUID, config RolesConfig, trail *auditTrail) error {
+	log.Println("Fetching all billing accounts and team IDs...")
+	scope, err := fetchRoleScope(db, config)
+	if err != nil {
+		return err
+	}
+	desired := desiredRoles(namespace, config.RoleTemplates(), scope)
+
+	existing, err := fetchExistingRoles(db)
+	if err != nil {
+		return err
+	}
+	// CUSTOM roles never satisfy a desired role by scope, but a CUSTOM
+	// template creates its role under the deterministic ID, so a row with
+	// that ID is already present whatever its type.
+	present := make(map[string]bool, len(existing))
+	presentIDs := make(map[string]bool, len(existing))
+	for _, role := range existing {
+		presentIDs[role.ID] = true
+		if role.Type == "CUSTOM" {
+			continue
+		}
+		present[roleScopeKey(role.Name, nullableString(role.TeamID), role.BillingID.String)] = true
+	}
+
+	stmt, err := db.Prepare(`INSERT INTO roles (id, name, type, team_id, billing_id) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("error preparing insert statement: %v", err)
+	}
+	defer stmt.Close()
+
+	legacy := legacyRolesByRole(config.RoleNameMapping())
+	wanted := make(map[string]bool, len(desired))
+	inserted := 0
+	for _, role := range desired {
+		key := roleScopeKey(role.Name, role.TeamID, role.BillingID)
+		wanted[key] = true
+		if present[key] || presentIDs[role.ID] {
+			continue
+		}
+		if err := insertRole(stmt, role); err != nil {
+			return err
+		}
+		if err := trail.Add(auditEntityRole, role.ID, legacy[role.Name], role); err != nil {
+			return err
+		}
+		inserted++
+	}
+
+	extra := 0
+	for _, role := range existing {
+		if role.Type == "CUSTOM" || wanted[roleScopeKey(role.Name, nullableString(role.TeamID), role.BillingID.String)] {
+			continue
+		}
+		extra++
+		log.Printf("Extra role not in the desired set (left in place): ID: %s, Name: %s, Type: %s, Team ID: %s, Billing ID: %s",
+			role.ID, role.Name, role.Type, role.TeamID.String, role.BillingID.String)
+	}
+
+	log.Printf("Reconciled roles: %d desired, %d already present, %d inserted, %d extra reported.",
+		len(desired), len(desired)-inserted, inserted, extra)
+	return nil
+}
+
+func fetchExistingRoles(db *sql.DB) ([]existingRole, error) {
+	rows, err := db.Query("SELECT id, name, type, team_id, billing_id FROM roles")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching existing roles: %v", err)
+	}
+	defer rows.Close()
+
+	var roles []existingRole
+	for rows.Next() {
+		var role existingRole
+		if err := rows.Scan(&role.ID, &role.Name, &role.Type, &role.TeamID, &role.BillingID); err != nil {
+			return nil, fmt.Errorf("error scanning existing role: %v", err)
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// roleScopeKey identifies a role by what it grants rather than by its ID.
+func roleScopeKey(name string, teamId *string, billingId string) string {
+	team := ""
+	if teamId != nil {
+		team = *teamId
+	}
+	return billingId + "/" + team + "/" + name
+}
+
+func nullableString(value sql.NullString) *string {
+	if !value.Valid {
+		return nil
+	}
+	return &value.String
+}
+
+// mergeDuplicateBillingRoles collapses billing-level roles that earlier runs
+// created once per team into a single role per billing account and name. The
+// role with the deterministic ID is kept when present, otherwise the lowest
+// ID. Assignments in user_roles_mapping are moved to the kept role before the
+// duplicates and their permission mappings are deleted.
+func mergeDuplicateBillingRoles(db *sql.DB, namespace uuid.UUID) error {
+	rows, err := db.Query(`SELECT billing_id, name, id
+              FROM roles
+              WHERE team_id IS NULL AND type = 'BILLING'
+              ORDER BY billing_id, name, id`)
+	if err != nil {
+		return fmt.Errorf("error fetching billing roles: %v", err)
+	}
+	defer rows.Close()
+
+	type duplicateSet struct {
+		billingId, name string
+		ids             []string
+	}
+	var all []duplicateSet
+	for rows.Next() {
+		var billingId, name, id string
+		if err := rows.Scan(&billingId, &name, &id); err != nil {
+			return fmt.Errorf("error scanning billing role: %v", err)
+		}
+		if n := len(all); n > 0 && all[n-1].billingId == billingId && all[n-1].name == name {
+			all[n-1].ids = append(all[n-1].ids, id)
+			continue
+		}
+		all = append(all, duplicateSet{billingId: billingId, name: name, ids: []string{id}})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	var sets []duplicateSet
+	for _, set := range all {
+		if len(set.ids) > 1 {
+			sets = append(sets, set)
+		}
+	}
+
+	for _, set := range sets {
+		keep := set.ids[0]
+		preferred := roleID(namespace, set.name, nil, set.billingId)
+		for _, id := range set.ids {
+			if id == preferred {
+				keep = id
+			}
+		}
+
+		var duplicates []string
+		for _, id := range set.ids {
+			if id != keep {
+				duplicates = append(duplicates, id)
+			}
+		}
+		moved, err := mergeRoles(db, keep, duplicates)
+		if err != nil {
+			return fmt.Errorf("error merging %s roles for billing ID %s: %v", set.name, set.billingId, err)
+		}
+		log.Printf("Merged %d duplicate %s roles for billing ID %s into %s (%d assignments repointed).",
+			len(duplicates), set.name, set.billingId, keep, moved)
+	}
+
+	log.Printf("Merged duplicate billing roles for %d billing account/role pairs.", len(sets))
+	return nil
+}
+
+// mergeRoles repoints the user assignments of the duplicate roles to keep and
+// deletes the duplicates, all in one transaction.
+func mergeRoles(db *sql.DB, keep string, duplicates []string) (int64, error) {
+	in := placeholders(len(duplicates))
+	args := make([]interface{}, 0, len(duplicates)+1)
+	args = append(args, keep)
+	for _, id := range duplicates {
+		args = append(args, id)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT IGNORE INTO user_roles_mapping (user_id, role_id)
+              SELECT user_id, ? FROM user_roles_mapping WHERE role_id IN (`+in+`)`, args...)
+	if err != nil {
+		return 0, err
+	}
+	moved, _ := result.RowsAffected()
+
+	if _, err := tx.Exec(`DELETE FROM user_roles_mapping WHERE role_id IN (`+in+`)`, args[1:]...); err != nil {
+		return 0, err
+	}
+	// The kept role already holds the same catalog permissions.
+	if _, err := tx.Exec(`DELETE FROM role_permissions_mapping WHERE role_id IN (`+in+`)`, args[1:]...); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM roles WHERE id IN (`+in+`)`, args[1:]...); err != nil {
+		return 0, err
+	}
+	return moved, tx.Commit()
+}
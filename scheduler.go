@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+)
+
+// tableRunResult is the outcome of scheduling every manifest table.
+// PostLoadFailed lists tables whose rows were committed but whose post-load
+// step or checkpoint update failed afterwards.
+type tableRunResult struct {
+	Committed      []string
+	PostLoadFailed []string
+	Failed         []string
+	NotStarted     []string
+}
+
+// postLoadError is returned by migrateTable for failures that happen after
+// the table's rows were committed.
+type postLoadError struct {
+	err error
+}
+
+func (e *postLoadError) Error() string {
+	return e.err.Error()
+}
+
+// runTables migrates tables with up to concurrency workers. A table is only
+// started once every table it references is in done. After the first failure
+// no new tables are started; tables already running are allowed to finish.
+func runTables(specs []TableSpec, graph *dependencyGraph, done map[string]bool, concurrency int, migrate func(TableSpec) error) tableRunResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	type finished struct {
+		table string
+		err   error
+	}
+	results := make(chan finished)
+	started := make(map[string]bool)
+	running := 0
+
+	var result tableRunResult
+	for {
+		for _, spec := range specs {
+			if len(result.Failed)+len(result.PostLoadFailed) > 0 || running >= concurrency {
+				break
+			}
+			if started[spec.Name] || done[spec.Name] || !graph.ready(spec.Name, done) {
+				continue
+			}
+			started[spec.Name] = true
+			running++
+			go func(spec TableSpec) {
+				results <- finished{table: spec.Name, err: migrate(spec)}
+			}(spec)
+		}
+
+		if running == 0 {
+			break
+		}
+		r := <-results
+		running--
+		if r.err != nil {
+			log.Printf("Failed to migrate table %s: %v", r.table, r.err)
+			var postLoad *postLoadError
+			if errors.As(r.err, &postLoad) {
+				result.PostLoadFailed = append(result.PostLoadFailed, r.table)
+			} else {
+				result.Failed = append(result.Failed, r.table)
+			}
+			continue
+		}
+		done[r.table] = true
+		result.Committed = append(result.Committed, r.table)
+	}
+
+	for _, spec := range specs {
+		if !started[spec.Name] && !done[spec.Name] {
+			result.NotStarted = append(result.NotStarted, spec.Name)
+		}
+	}
+	return result
+}
+
+// configurePool applies the connection pool settings to a database handle.
+func configurePool(db *sql.DB, opts migrationOptions) {
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	db.SetMaxIdleConns(opts.MaxIdleConns)
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// errSnapshotSealed is returned when the pool needs a connection after the
+// snapshot was taken; a new connection would read newer data.
+var errSnapshotSealed = errors.New("source snapshot connections are exhausted; no new connection can join the snapshot")
+
+// snapshotPosition is the binlog position of the source snapshot, written to
+// the -snapshot-out file so a later delta sync can start from it. Consistent
+// is false when the read lock could not be taken and the position was read
+// just after the snapshot rather than at it.
+type snapshotPosition struct {
+	File          string    `json:"file"`
+	Position      uint64    `json:"position"`
+	ExecutedGTIDs string    `json:"executed_gtid_set,omitempty"`
+	Consistent    bool      `json:"consistent"`
+	Connections   int       `json:"connections"`
+	TakenAt       time.Time `json:"taken_at"`
+}
+
+// snapshotConnector starts a consistent-snapshot transaction on every
+// connection it opens. Once sealed it refuses to open more, so every query
+// made through the pool reads from the same snapshot.
+type snapshotConnector struct {
+	driver.Connector
+	mu     sync.Mutex
+	sealed bool
+}
+
+func (c *snapshotConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sealed {
+		return nil, errSnapshotSealed
+	}
+
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		conn.Close()
+		return nil, errors.New("source driver cannot execute statements on a raw connection")
+	}
+	for _, statement := range []string{
+		"SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+		"START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY",
+	} {
+		if _, err := execer.ExecContext(ctx, statement, nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error starting snapshot transaction: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *snapshotConnector) seal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sealed = true
+}
+
+// openSnapshot opens a source pool of up to workers connections that all read
+// from one consistent snapshot, and records the snapshot's binlog position
+// in positionPath. The connections are opened while FLUSH TABLES WITH READ
+// LOCK is held, which briefly blocks writes on the source. Without the
+// privilege to take that lock the pool is limited to a single connection:
+// the snapshot stays consistent, but the recorded position is approximate
+// and tables are read one at a time whatever -concurrency is.
+func openSnapshot(dsn string, workers int, positionPath string) (*sql.DB, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("snapshot needs at least one connection, got %d", workers)
+	}
+	ctx := context.Background()
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing source DSN: %v", err)
+	}
+	base, err := mysql.NewConnector(config)
+	if err != nil {
+		return nil, err
+	}
+
+	lockDB := sql.OpenDB(base)
+	defer lockDB.Close()
+	lockConn, err := lockDB.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to source database: %v", err)
+	}
+	defer lockConn.Close()
+
+	position := snapshotPosition{Consistent: true}
+	if _, err := lockConn.ExecContext(ctx, "FLUSH TABLES WITH READ LOCK"); err != nil {
+		log.Printf("Could not lock the source for the snapshot (%v); using a single connection and an approximate binlog position", err)
+		// workers is -concurrency plus one spare connection.
+		if workers > 2 {
+			log.Printf("The run is effectively serial: the %d table workers share the snapshot's single connection", workers-1)
+		}
+		position.Consistent = false
+		workers = 1
+	}
+
+	connector := &snapshotConnector{Connector: base}
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(workers)
+	db.SetMaxIdleConns(workers)
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
+
+	// Hold every connection at once so the pool opens all of them now.
+	conns := make([]*sql.Conn, 0, workers)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < workers; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			lockConn.ExecContext(ctx, "UNLOCK TABLES")
+			db.Close()
+			return nil, fmt.Errorf("error opening snapshot connection: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+
+	err = readBinlogPosition(ctx, lockConn, &position)
+	if position.Consistent {
+		if _, unlockErr := lockConn.ExecContext(ctx, "UNLOCK TABLES"); err == nil {
+			err = unlockErr
+		}
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	connector.seal()
+
+	position.Connections = workers
+	position.TakenAt = time.Now().UTC()
+	if err := writeSnapshotPosition(positionPath, position); err != nil {
+		db.Close()
+		return nil, err
+	}
+	log.Printf("Reading the source from a consistent snapshot on %d connections at binlog %s:%d (recorded in %s)",
+		workers, position.File, position.Position, positionPath)
+	return db, nil
+}
+
+// readBinlogPosition reads the current binlog file and position. MySQL 8.4
+// renamed SHOW MASTER STATUS, so both spellings are tried.
+func readBinlogPosition(ctx context.Context, conn *sql.Conn, position *snapshotPosition) error {
+	rows, err := conn.QueryContext(ctx, "SHOW MASTER STATUS")
+	if err != nil {
+		rows, err = conn.QueryContext(ctx, "SHOW BINARY LOG STATUS")
+	}
+	if err != nil {
+		return fmt.Errorf("error reading binlog position: %v", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return errors.New("source has binary logging disabled; no binlog position to record")
+	}
+	values := make([]sql.NullString, len(columns))
+	valuePtrs := make([]interface{}, len(columns))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+	if err := rows.Scan(valuePtrs...); err != nil {
+		return fmt.Errorf("error scanning binlog position: %v", err)
+	}
+	for i, col := range columns {
+		switch col {
+		case "File":
+			position.File = values[i].String
+		case "Position":
+			if position.Position, err = strconv.ParseUint(values[i].String, 10, 64); err != nil {
+				return fmt.Errorf("error parsing binlog position %q: %v", values[i].String, err)
+			}
+		case "Executed_Gtid_Set":
+			position.ExecutedGTIDs = values[i].String
+		}
+	}
+	return rows.Err()
+}
+
+func writeSnapshotPosition(path string, position snapshotPosition) error {
+	data, err := json.MarshalIndent(position, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding snapshot position: %v", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing snapshot position %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// tableVerification compares what a table's source query produces with what
+// ended up in its destination table.
+type tableVerification struct {
+	Table               string
+	Destination         string
+	SourceRows          int64
+	SkippedRows         int64
+	SkippedAllowed      bool
+	DestinationRows     int64
+	SourceChecksum      uint64
+	DestinationChecksum uint64
+}
+
+// Matches reports whether the destination holds every source row. Skipped
+// rows are only discounted when the migrator allows them.
+func (v tableVerification) Matches() bool {
+	if v.SkippedRows > 0 && !v.SkippedAllowed {
+		return false
+	}
+	return v.SourceRows-v.SkippedRows == v.DestinationRows && v.SourceChecksum == v.DestinationChecksum
+}
+
+// verificationSkipper is implemented by migrators whose destination table is
+// rewritten after the copy, so it cannot be compared with the source.
+type verificationSkipper interface {
+	SkipVerification() string
+}
+
+// runVerify checks every manifest table except those whose migrator skips
+// verification, and returns the number of tables whose row count or
+// checksum differs.
+func runVerify(sourceDB, destDB *sql.DB, manifest *Manifest) (int, error) {
+	mismatches := 0
+	for _, spec := range manifest.Tables {
+		migrator := newTableMigrator(spec)
+		if skipper, ok := migrator.(verificationSkipper); ok {
+			log.Printf("%-8s %s -> %s: %s", "SKIPPED", spec.Name, spec.DestinationTable(), skipper.SkipVerification())
+			continue
+		}
+
+		result, err := verifyTable(sourceDB, destDB, migrator)
+		if err != nil {
+			return mismatches, fmt.Errorf("error verifying table %s: %v", spec.Name, err)
+		}
+
+		status := "OK"
+		if !result.Matches() {
+			status = "MISMATCH"
+			mismatches++
+		}
+		log.Printf("%-8s %s -> %s: source rows %d (skipped %d), destination rows %d, checksum %016x / %016x",
+			status, result.Table, result.Destination, result.SourceRows, result.SkippedRows, result.DestinationRows,
+			result.SourceChecksum, result.DestinationChecksum)
+	}
+	return mismatches, nil
+}
+
+// destinationFilterer is implemented by migrators whose destination table
+// also holds rows that do not come from the source table. Verification only
+// compares the destination rows matching the filter.
+type destinationFilterer interface {
+	DestinationFilter() string
+}
+
+// verifyTable checksums the table's source query, run through the migrator's
+// row transform, and the mapped columns of the destination table. The
+// checksum is a sum of per-row hashes, so row order does not matter.
+func verifyTable(sourceDB, destDB *sql.DB, migrator TableMigrator) (tableVerification, error) {
+	spec := migrator.Spec()
+	result := tableVerification{Table: spec.Name, Destination: spec.DestinationTable(), SkippedAllowed: skippedRowsAllowed(migrator)}
+
+	sourceRows, err := sourceDB.Query(migrator.SourceQuery())
+	if err != nil {
+		return result, fmt.Errorf("error querying source: %v", err)
+	}
+	defer sourceRows.Close()
+
+	sourceColumns, err := sourceRows.Columns()
+	if err != nil {
+		return result, err
+	}
+	columns := migrator.DestinationColumns(sourceColumns)
+
+	result.SourceRows, result.SkippedRows, result.SourceChecksum, err = checksumRows(sourceRows, migrator.TransformRow)
+	if err != nil {
+		return result, fmt.Errorf("error reading source rows: %v", err)
+	}
+
+	quoted := make([]string, len(columns))
+	for i, col := range columns {
+		quoted[i] = fmt.Sprintf("`%s`", col)
+	}
+	destQuery := fmt.Sprintf("SELECT %s FROM %s", strings.Join(quoted, ", "), result.Destination)
+	if filterer, ok := migrator.(destinationFilterer); ok {
+		destQuery += " WHERE " + filterer.DestinationFilter()
+	}
+	destRows, err := destDB.Query(destQuery)
+	if err != nil {
+		return result, fmt.Errorf("error querying destination: %v", err)
+	}
+	defer destRows.Close()
+
+	result.DestinationRows, _, result.DestinationChecksum, err = checksumRows(destRows, nil)
+	if err != nil {
+		return result, fmt.Errorf("error reading destination rows: %v", err)
+	}
+	return result, nil
+}
+
+func checksumRows(rows *sql.Rows, transform func([]interface{}) ([]interface{}, error)) (count, skipped int64, sum uint64, err error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	values := make([]interface{}, len(columns))
+	valuePtrs := make([]interface{}, len(columns))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return count, skipped, sum, err
+		}
+		count++
+
+		row := values
+		if transform != nil {
+			row, err = transform(values)
+			if err == errSkipRow {
+				skipped++
+				continue
+			}
+			if err != nil {
+				return count, skipped, sum, err
+			}
+		}
+		sum += rowHash(row)
+	}
+	return count, skipped, sum, rows.Err()
+}
+
+func rowHash(row []interface{}) uint64 {
+	h := fnv.New64a()
+	for _, value := range row {
+		if value == nil {
+			h.Write([]byte{0})
+		} else {
+			h.Write([]byte(normalizeValue(value)))
+		}
+		h.Write([]byte{0x1f})
+	}
+	return h.Sum64()
+}
+
+var fractionalDatetime = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}\.\d+$`)
+
+// normalizeValue renders a value so the same data compares equal on both
+// sides, e.g. a DATETIME and a DATETIME(6) holding the same instant.
+func normalizeValue(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case []byte:
+		s = string(v)
+	case time.Time:
+		s = v.Format("2006-01-02 15:04:05.999999")
+	default:
+		s = fmt.Sprint(v)
+	}
+	if fractionalDatetime.MatchString(s) {
+		s = strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}